@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"sort"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -36,6 +37,18 @@ func ContainerValidArgs(cmd *cobra.Command, args []string, toComplete string) ([
 	return completeAvailableContainers(s, toComplete)
 }
 
+func ContextValidArgs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeKubeconfigNames("contexts", toComplete)
+}
+
+func ClusterValidArgs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeKubeconfigNames("clusters", toComplete)
+}
+
+func UserValidArgs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeKubeconfigNames("users", toComplete)
+}
+
 func initCompletionCliSession() (*cliSession, error) {
 	return NewCliSession(&cliopts)
 }
@@ -91,3 +104,41 @@ func completeAvailableContainers(c *cliSession, toComplete string) ([]string, co
 
 	return ctrs, cobra.ShellCompDirectiveNoFileComp
 }
+
+// names of contexts, clusters or users in the kubeconfig, without contacting the cluster
+func completeKubeconfigNames(kind string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	c := &cliSession{opts: cliopts}
+	if err := c.prepClientConfig(); err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	raw, err := c.clientConfig.RawConfig()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var all []string
+	switch kind {
+	case "contexts":
+		for name := range raw.Contexts {
+			all = append(all, name)
+		}
+	case "clusters":
+		for name := range raw.Clusters {
+			all = append(all, name)
+		}
+	case "users":
+		for name := range raw.AuthInfos {
+			all = append(all, name)
+		}
+	}
+
+	var names []string
+	for _, name := range all {
+		if strings.HasPrefix(name, toComplete) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+)
+
+// compressionStats compares the size of websocket messages with the bytes on
+// the underlying connection (including any TLS overhead), to show whether
+// compression is worthwhile. nil when compression is disabled.
+type compressionStats struct {
+	negotiated     bool
+	wireRead       atomic.Int64
+	wireWritten    atomic.Int64
+	payloadRead    atomic.Int64
+	payloadWritten atomic.Int64
+	// connection bytes used by the upgrade, excluded from the ratio
+	handshakeRead    int64
+	handshakeWritten int64
+}
+
+// wrap a dial func, counting the bytes read & written on each connection
+func (s *compressionStats) dial(next dialFunc) dialFunc {
+	if s == nil {
+		return next
+	}
+	if next == nil {
+		var d net.Dialer
+		next = d.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, stats: s}, nil
+	}
+}
+
+// check the server agreed to compress, the session works either way
+func (s *compressionStats) upgraded(resp *http.Response) {
+	if s == nil {
+		return
+	}
+
+	for _, ext := range resp.Header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(ext, "permessage-deflate") {
+			s.negotiated = true
+		}
+	}
+	if s.negotiated {
+		klog.V(4).Info("Negotiated permessage-deflate compression")
+	} else {
+		klog.V(2).Info("Server did not negotiate compression, continuing without it")
+	}
+
+	s.handshakeRead = s.wireRead.Load()
+	s.handshakeWritten = s.wireWritten.Load()
+}
+
+func (s *compressionStats) messageRead(n int) {
+	if s == nil {
+		return
+	}
+	s.payloadRead.Add(int64(n))
+}
+
+func (s *compressionStats) messageWritten(n int) {
+	if s == nil {
+		return
+	}
+	s.payloadWritten.Add(int64(n))
+}
+
+func (s *compressionStats) log() {
+	if s == nil || !s.negotiated {
+		return
+	}
+
+	wireRead := s.wireRead.Load() - s.handshakeRead
+	wireWritten := s.wireWritten.Load() - s.handshakeWritten
+	klog.V(4).Infof("Compression received %d bytes as %d on the wire (%s), sent %d bytes as %d (%s)",
+		s.payloadRead.Load(), wireRead, compressionRatio(s.payloadRead.Load(), wireRead),
+		s.payloadWritten.Load(), wireWritten, compressionRatio(s.payloadWritten.Load(), wireWritten))
+}
+
+func compressionRatio(payload, wire int64) string {
+	if payload == 0 || wire <= 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.2fx", float64(payload)/float64(wire))
+}
+
+type countingConn struct {
+	net.Conn
+	stats *compressionStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.wireRead.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.wireWritten.Add(int64(n))
+	return n, err
+}
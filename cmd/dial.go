@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// matches the dialer client-go uses by default
+const dialKeepAlive = 30 * time.Second
+
+// parse curl style host:port:addr overrides into a host:port -> addr:port map
+func parseResolve(entries []string) (map[string]string, error) {
+	overrides := map[string]string{}
+
+	for _, e := range entries {
+		parts := strings.SplitN(e, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("Invalid resolve entry %q, must be host:port:addr", e)
+		}
+		if _, err := strconv.ParseUint(parts[1], 10, 16); err != nil {
+			return nil, fmt.Errorf("Invalid port in resolve entry %q", e)
+		}
+
+		addr := strings.Trim(parts[2], "[]")
+		if net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("Invalid address in resolve entry %q", e)
+		}
+
+		overrides[net.JoinHostPort(parts[0], parts[1])] = net.JoinHostPort(addr, parts[1])
+	}
+
+	return overrides, nil
+}
+
+// whether any of --resolve, --connect-timeout, --bind-address or --via change
+// how connections are made
+func (c *cliSession) customDial() bool {
+	return len(c.opts.resolve) > 0 || c.opts.connectTimeout > 0 || c.opts.bindAddress != "" || c.opts.via != ""
+}
+
+// dial func for the API server & kubelets, combining --resolve,
+// --connect-timeout, --bind-address, --tls-handshake-timeout & --via. nil when
+// none are set.
+func (c *cliSession) prepDial() (dialFunc, error) {
+	if !c.customDial() && c.opts.tlsTimeout == 0 {
+		return nil, nil
+	}
+
+	base := &net.Dialer{KeepAlive: dialKeepAlive}
+	if c.opts.bindAddress != "" {
+		ip := net.ParseIP(c.opts.bindAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid bind address %q", c.opts.bindAddress)
+		}
+		base.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	dial := base.DialContext
+
+	if c.opts.via != "" {
+		tunnel, err := newSSHTunnel(c.opts.via, c.opts.viaIdentity, c.opts.viaKnownHosts)
+		if err != nil {
+			return nil, err
+		}
+		tunnel.dial = base.DialContext
+		c.tunnel = tunnel
+		dial = tunnel.DialContext
+	}
+
+	overrides, err := parseResolve(c.opts.resolve)
+	if err != nil {
+		return nil, err
+	}
+	timeout := c.opts.connectTimeout
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if override, ok := overrides[addr]; ok {
+			klog.V(4).Infof("Resolving %s to %s", addr, override)
+			addr = override
+		}
+
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if h, ok := ctx.Value(tlsHandshakeKey{}).(*tlsHandshakeTimeout); ok && err == nil {
+			h.dialled(conn)
+		}
+		return conn, err
+	}, nil
+}
+
+type tlsHandshakeKey struct{}
+
+// tlsHandshakeTimeout bounds the TLS handshake on the connection dialled for
+// a request, by setting a deadline on it between the TLSHandshakeStart & Done
+// trace hooks. Both the websocket dialer & net/http call these, whether or
+// not the connection goes through a proxy.
+type tlsHandshakeTimeout struct {
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (h *tlsHandshakeTimeout) dialled(conn net.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conn = conn
+}
+
+func (h *tlsHandshakeTimeout) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if h.conn == nil {
+				return
+			}
+			h.conn.SetDeadline(time.Now().Add(h.timeout))
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if h.conn == nil {
+				return
+			}
+			// a pooled connection is reused for later requests, so nothing
+			// is left behind, as with net.Dialer
+			h.conn.SetDeadline(time.Time{})
+			h.conn = nil
+		},
+	}
+}
+
+// tlsTimeoutRoundTripper gives each request its own handshake timeout, for
+// the dial func to find in the request context
+type tlsTimeoutRoundTripper struct {
+	timeout time.Duration
+	rt      http.RoundTripper
+}
+
+func (t *tlsTimeoutRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	h := &tlsHandshakeTimeout{timeout: t.timeout}
+	ctx := context.WithValue(r.Context(), tlsHandshakeKey{}, h)
+	ctx = httptrace.WithClientTrace(ctx, h.trace())
+	return t.rt.RoundTrip(r.WithContext(ctx))
+}
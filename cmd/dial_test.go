@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "none",
+			want: map[string]string{},
+		},
+		{
+			name:    "ipv4",
+			entries: []string{"api.example.com:443:10.0.0.1"},
+			want:    map[string]string{"api.example.com:443": "10.0.0.1:443"},
+		},
+		{
+			name:    "ipv6 with brackets",
+			entries: []string{"api.example.com:6443:[fd00::1]"},
+			want:    map[string]string{"api.example.com:6443": "[fd00::1]:6443"},
+		},
+		{
+			name:    "ipv6 without brackets",
+			entries: []string{"api.example.com:6443:fd00::1"},
+			want:    map[string]string{"api.example.com:6443": "[fd00::1]:6443"},
+		},
+		{
+			name:    "several hosts",
+			entries: []string{"a.example.com:443:10.0.0.1", "b.example.com:10250:10.0.0.2"},
+			want: map[string]string{
+				"a.example.com:443":   "10.0.0.1:443",
+				"b.example.com:10250": "10.0.0.2:10250",
+			},
+		},
+		{
+			name:    "missing address",
+			entries: []string{"api.example.com:443"},
+			wantErr: true,
+		},
+		{
+			name:    "empty host",
+			entries: []string{":443:10.0.0.1"},
+			wantErr: true,
+		},
+		{
+			name:    "port out of range",
+			entries: []string{"api.example.com:65536:10.0.0.1"},
+			wantErr: true,
+		},
+		{
+			name:    "hostname instead of an address",
+			entries: []string{"api.example.com:443:other.example.com"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseResolve(tt.entries)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// accepts connections but never answers the TLS handshake
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	go func() {
+		for {
+			conn, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// completes the handshake, then is slower to respond than the timeout
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	tests := []struct {
+		name           string
+		url            string
+		connectTimeout time.Duration
+		wantErr        bool
+	}{
+		{
+			name:    "stalled handshake times out",
+			url:     "https://" + stalled.Addr().String(),
+			wantErr: true,
+		},
+		{
+			name: "slow response after the handshake is not bounded",
+			url:  slow.URL,
+		},
+		{
+			name:           "response after the connect timeout",
+			url:            slow.URL,
+			connectTimeout: 50 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &cliSession{opts: Options{tlsTimeout: 50 * time.Millisecond, connectTimeout: tt.connectTimeout}}
+			dial, err := c.prepDial()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			transport := &http.Transport{
+				DialContext:     dial,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}
+			defer transport.CloseIdleConnections()
+			client := &http.Client{
+				Transport: &tlsTimeoutRoundTripper{timeout: c.opts.tlsTimeout, rt: transport},
+				Timeout:   5 * time.Second,
+			}
+
+			start := time.Now()
+			resp, err := client.Get(tt.url)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("request succeeded")
+				}
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Errorf("took %s to time out", elapsed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the pooled connection must be left without a deadline
+			resp, err = client.Get(tt.url)
+			if err != nil {
+				t.Fatalf("second request: %v", err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/client-go/rest"
+)
+
+const doctorTimeout = 10 * time.Second
+
+type doctorStatus string
+
+const (
+	doctorOK   doctorStatus = " OK "
+	doctorWarn doctorStatus = "WARN"
+	doctorFail doctorStatus = "FAIL"
+	doctorSkip doctorStatus = "SKIP"
+)
+
+type doctorReport struct {
+	out    io.Writer
+	failed bool
+}
+
+func (r *doctorReport) step(status doctorStatus, name string, format string, args ...interface{}) {
+	if status == doctorFail {
+		r.failed = true
+	}
+	fmt.Fprintf(r.out, "[%s] %-12s %s\n", status, name, fmt.Sprintf(format, args...))
+}
+
+// upgradeProbe completes the websocket handshake then hangs up straight away
+type upgradeProbe struct {
+	Dialer      *websocket.Dialer
+	Subprotocol string
+}
+
+func (p *upgradeProbe) RoundTrip(r *http.Request) (*http.Response, error) {
+	conn, resp, err := dialWebsocket(p.Dialer, r)
+	if err != nil {
+		return nil, err
+	}
+	p.Subprotocol = conn.Subprotocol()
+	conn.Close()
+	return resp, nil
+}
+
+func runDoctor(o *Options, out io.Writer) error {
+	r := &doctorReport{out: out}
+
+	c, err := NewCliSession(o)
+	if err != nil {
+		r.step(doctorFail, "kubeconfig", "%s", err)
+		return errors.New("One or more checks failed")
+	}
+	defer c.Close()
+
+	raw, err := c.clientConfig.RawConfig()
+	ctxName := c.opts.Context
+	if err == nil && ctxName == "" {
+		ctxName = raw.CurrentContext
+	}
+	if c.inCluster {
+		r.step(doctorOK, "kubeconfig", "in-cluster service account, server %s, namespace %s", c.restConfig.Host, c.namespace)
+	} else {
+		r.step(doctorOK, "kubeconfig", "context %q, server %s, namespace %s", ctxName, c.restConfig.Host, c.namespace)
+	}
+
+	if c.tunnel != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+		_, err := c.tunnel.connect(ctx)
+		cancel()
+		if err != nil {
+			r.step(doctorFail, "bastion", "%s", err)
+			return errors.New("One or more checks failed")
+		}
+		r.step(doctorOK, "bastion", "connected to %s as %s", c.tunnel.addr, c.tunnel.user)
+	}
+
+	u, err := url.Parse(c.restConfig.Host)
+	if err != nil {
+		r.step(doctorFail, "server", "unable to parse server URL: %s", err)
+		return errors.New("One or more checks failed")
+	}
+	hostPort := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "http":
+			hostPort = net.JoinHostPort(u.Hostname(), "80")
+		default:
+			hostPort = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+
+	proxyURL, err := effectiveProxy(c.restConfig)(&http.Request{URL: u})
+	switch {
+	case err != nil:
+		r.step(doctorFail, "proxy", "unable to determine proxy: %s", err)
+	case proxyURL != nil:
+		r.step(doctorOK, "proxy", "using %s", proxyURL.Redacted())
+	default:
+		r.step(doctorOK, "proxy", "direct connection")
+	}
+
+	if proxyURL != nil {
+		r.step(doctorSkip, "tcp", "connection is proxied, see upgrade check")
+		r.step(doctorSkip, "tls", "connection is proxied, see upgrade check")
+	} else {
+		c.doctorConnect(r, u, hostPort)
+	}
+
+	if c.opts.Pod == "" {
+		r.step(doctorSkip, "upgrade", "no pod given")
+		r.step(doctorSkip, "kubelet", "no pod given")
+		r.step(doctorSkip, "rbac", "no pod given")
+	} else {
+		if err := c.sanityCheck(); err != nil {
+			r.step(doctorFail, "pod", "%s", err)
+		} else if !c.opts.noSanityCheck {
+			r.step(doctorOK, "pod", "%s/%s on node %s", c.namespace, c.opts.Pod, c.opts.PodSpec.NodeName)
+		}
+
+		c.doctorUpgrade(r)
+		c.doctorKubelet(r)
+		c.doctorRBAC(r)
+	}
+
+	if r.failed {
+		return errors.New("One or more checks failed")
+	}
+	return nil
+}
+
+// dial as the exec would, through any bastion
+func (c *cliSession) doctorDial(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+
+	if c.restConfig.Dial != nil {
+		return c.restConfig.Dial(ctx, "tcp", addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func (c *cliSession) doctorConnect(r *doctorReport, u *url.URL, hostPort string) {
+	start := time.Now()
+	conn, err := c.doctorDial(hostPort)
+	if err != nil {
+		r.step(doctorFail, "tcp", "%s", err)
+		r.step(doctorSkip, "tls", "no TCP connection")
+		return
+	}
+	defer conn.Close()
+	r.step(doctorOK, "tcp", "connected to %s in %s", conn.RemoteAddr(), time.Since(start).Round(time.Millisecond))
+
+	if u.Scheme != "https" {
+		r.step(doctorSkip, "tls", "server is not using https")
+		return
+	}
+
+	tlsConfig, err := rest.TLSConfigFor(c.restConfig)
+	if err != nil {
+		r.step(doctorFail, "tls", "%s", err)
+		return
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+
+	start = time.Now()
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		r.step(doctorFail, "tls", "%s", err)
+		return
+	}
+	state := tlsConn.ConnectionState()
+	r.step(doctorOK, "tls", "%s handshake in %s", tls.VersionName(state.Version), time.Since(start).Round(time.Millisecond))
+}
+
+func (c *cliSession) doctorUpgrade(r *doctorReport) {
+	var req *http.Request
+	var err error
+	switch c.opts.directExec {
+	case directExecKubelet:
+		r.step(doctorSkip, "upgrade", "API server exec not used with direct exec")
+		return
+	case directExecProxy:
+		req, err = c.prepNodeProxyExec()
+	default:
+		req, err = c.prepExec()
+	}
+	if err != nil {
+		r.step(doctorFail, "upgrade", "%s", err)
+		return
+	}
+
+	dialer, err := c.newDialer(c.restConfig)
+	if err != nil {
+		r.step(doctorFail, "upgrade", "%s", err)
+		return
+	}
+	dialer.HandshakeTimeout = doctorTimeout
+
+	probe := &upgradeProbe{Dialer: dialer}
+	rter, err := rest.HTTPWrappersForConfig(c.restConfig, probe)
+	if err != nil {
+		r.step(doctorFail, "upgrade", "%s", err)
+		return
+	}
+
+	_, err = rter.RoundTrip(req)
+	if err != nil {
+		r.step(doctorFail, "upgrade", "%s", err)
+		return
+	}
+	r.step(doctorOK, "upgrade", "negotiated subprotocol %q", probe.Subprotocol)
+}
+
+func (c *cliSession) doctorKubelet(r *doctorReport) {
+	// only a hard failure when direct exec has been asked for
+	failStatus := doctorWarn
+	switch c.opts.directExec {
+	case directExecKubelet:
+		failStatus = doctorFail
+	case directExecProxy:
+		r.step(doctorSkip, "kubelet", "kubelet is reached via the API server node proxy")
+		return
+	}
+
+	if len(c.opts.directExecIps) == 0 && c.opts.PodSpec.NodeName == "" {
+		r.step(doctorSkip, "kubelet", "node of pod is unknown")
+		return
+	}
+
+	addr, err := c.getKubeletAddress()
+	if err != nil {
+		r.step(failStatus, "kubelet", "%s", err)
+		return
+	}
+
+	conn, err := c.doctorDial(addr)
+	if err != nil {
+		r.step(failStatus, "kubelet", "%s", err)
+		return
+	}
+	conn.Close()
+	r.step(doctorOK, "kubelet", "%s is reachable", addr)
+}
+
+func (c *cliSession) doctorRBAC(r *doctorReport) {
+	results, err := c.checkAccess()
+	if err != nil {
+		r.step(doctorFail, "rbac", "%s", err)
+		return
+	}
+	for _, res := range results {
+		if res.Allowed {
+			r.step(doctorOK, "rbac", "can %s", res.Check)
+		} else {
+			r.step(doctorFail, "rbac", "cannot %s", res.Check)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const dumpTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// frameDumper writes every websocket message of a session to a file, as sent
+// or received on the wire, for debugging proxies that mangle the protocol. nil
+// when --dump-frames isn't set.
+type frameDumper struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// the dump includes everything sent to stdin, so is only readable by the user
+func newFrameDumper(path string) (*frameDumper, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open frame dump: %w", err)
+	}
+	// an existing file keeps its mode when truncated
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Unable to open frame dump: %w", err)
+	}
+	return &frameDumper{f: f}, nil
+}
+
+func (d *frameDumper) negotiated(protocol string) {
+	if d == nil {
+		return
+	}
+	d.write("# subprotocol %s", protocol)
+}
+
+// a data message, split into the channel byte and the rest of the payload
+func (d *frameDumper) frame(direction string, msgType int, channel byte, payload []byte) {
+	if d == nil {
+		return
+	}
+	kind := "binary"
+	if msgType == websocket.TextMessage {
+		kind = "text"
+	}
+	d.write("%s %s %s channel=%#02x length=%d %q",
+		time.Now().Format(dumpTimeFormat), direction, kind, channel, len(payload), payload)
+}
+
+func (d *frameDumper) closed(err error) {
+	if d == nil {
+		return
+	}
+	if e, ok := err.(*websocket.CloseError); ok {
+		d.write("%s recv close code=%d %q", time.Now().Format(dumpTimeFormat), e.Code, e.Text)
+	}
+}
+
+func (d *frameDumper) write(format string, args ...interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintf(d.f, format+"\n", args...)
+}
+
+func (d *frameDumper) Close() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.f.Close()
+}
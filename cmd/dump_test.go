@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFrameDumper(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frames")
+	d, err := newFrameDumper(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.negotiated("v4.base64.channel.k8s.io")
+	d.frame("send", websocket.BinaryMessage, streamStdIn, []byte("ls\n"))
+	d.frame("recv", websocket.TextMessage, '1', []byte("aGk="))
+	d.frame("recv", websocket.BinaryMessage, streamStdOut, []byte{0xff, '"'})
+	d.closed(errors.New("read: connection reset"))
+	d.closed(&websocket.CloseError{Code: websocket.CloseNormalClosure, Text: "done"})
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+
+	// every line but the subprotocol starts with the time
+	timestamp := regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{6}\S* `)
+	want := []string{
+		"# subprotocol v4.base64.channel.k8s.io",
+		`send binary channel=0x00 length=3 "ls\n"`,
+		`recv text channel=0x31 length=4 "aGk="`,
+		`recv binary channel=0x01 length=2 "\xff\""`,
+		`recv close code=1000 "done"`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), data)
+	}
+	for i, line := range lines {
+		if i > 0 {
+			ts := timestamp.FindString(line)
+			if ts == "" {
+				t.Errorf("line %d has no timestamp: %q", i, line)
+				continue
+			}
+			if _, err := time.Parse(dumpTimeFormat, strings.TrimSpace(ts)); err != nil {
+				t.Errorf("line %d: %v", i, err)
+			}
+			line = strings.TrimPrefix(line, ts)
+		}
+		if line != want[i] {
+			t.Errorf("line %d: got %q, want %q", i, line, want[i])
+		}
+	}
+}
+
+func TestFrameDumperMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frames")
+	if err := os.WriteFile(path, []byte("old contents"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newFrameDumper(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("got mode %v, want 0600", fi.Mode().Perm())
+	}
+	if fi.Size() != 0 {
+		t.Errorf("existing dump was not truncated, %d bytes", fi.Size())
+	}
+}
+
+func TestFrameDumperDisabled(t *testing.T) {
+	var d *frameDumper
+	d.negotiated("v4.channel.k8s.io")
+	d.frame("send", websocket.BinaryMessage, streamStdIn, []byte("x"))
+	d.closed(&websocket.CloseError{Code: websocket.CloseNormalClosure})
+	if err := d.Close(); err != nil {
+		t.Error(err)
+	}
+}
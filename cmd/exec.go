@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/moby/term"
@@ -15,6 +17,7 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/klog/v2"
 )
 
@@ -30,20 +33,75 @@ type Options struct {
 	PodSpec          corev1.PodSpec
 	noSanityCheck    bool
 	noTLSVerify      bool
-	directExec       bool
-	directExecNodeIp string
+	directExec       string
+	directExecIps    []string
+	kubeletAddrTypes []string
+	kubeletPort      int
+	kubeletCreds     kubeletCredentials
+	kubeletRun       bool
+	rbacPreflight    bool
+	Timings          bool
+	Transport        string
+	Protocols        []string
+	proxy            string
+	via              string
+	viaIdentity      string
+	viaKnownHosts    string
+	resolve          []string
+	connectTimeout   time.Duration
+	tlsTimeout       time.Duration
+	bindAddress      string
 	Loglevel         int
 	Impersonate      string
+	ImpersonateGrps  []string
+	ImpersonateUID   string
 	Context          string
+	cluster          string
+	user             string
+	server           string
+	token            string
+	caFile           string
+	clientCert       string
+	clientKey        string
+	tlsServerName    string
+	requestTimeout   string
+	headers          []string
+	headerFile       string
+	compress         bool
+	stats            string
+	dumpFrames       string
+	logPayloads      bool
+	optionalConfig   bool
 }
 
 var protocols = []string{
+	"v5.channel.k8s.io",
 	"v4.channel.k8s.io",
 	"v3.channel.k8s.io",
 	"v2.channel.k8s.io",
 	"channel.k8s.io",
 }
 
+// what each protocol version supports on top of the basic stdio channels
+type protocolFeatures struct {
+	resize      bool
+	statusError bool
+	base64      bool
+	closeStdin  bool
+}
+
+// https://github.com/kubernetes/kubernetes/blob/1a2f167d399b046bea6192df9e9b1ca7ac4f2365/staging/src/k8s.io/client-go/tools/remotecommand/remotecommand.go
+var channelProtocols = map[string]protocolFeatures{
+	"v5.channel.k8s.io": {resize: true, statusError: true, closeStdin: true},
+	"v4.channel.k8s.io": {resize: true, statusError: true},
+	"v3.channel.k8s.io": {resize: true},
+	"v2.channel.k8s.io": {},
+	"channel.k8s.io":    {},
+	// text frame variants for proxies that mangle binary frames
+	"v4.base64.channel.k8s.io": {resize: true, statusError: true, base64: true},
+	"base64.channel.k8s.io":    {base64: true},
+}
+
 // https://github.com/kubernetes/kubernetes/blob/1a2f167d399b046bea6192df9e9b1ca7ac4f2365/staging/src/k8s.io/client-go/tools/remotecommand/remotecommand_websocket.go#L35
 const (
 	streamStdIn  = 0
@@ -51,6 +109,8 @@ const (
 	streamStdErr = 2
 	streamErr    = 3
 	streamResize = 4
+	// v5 only, followed by the channel being closed
+	streamClose = 255
 )
 
 type cliSession struct {
@@ -60,6 +120,12 @@ type cliSession struct {
 	k8sClient    *kubernetes.Clientset
 	namespace    string
 	RawMode      bool
+	timings      *sessionTimings
+	stats        *transferStats
+	nodeIP       string
+	podUID       string
+	tunnel       *sshTunnel
+	inCluster    bool
 }
 
 func NewCliSession(o *Options) (*cliSession, error) {
@@ -67,6 +133,14 @@ func NewCliSession(o *Options) (*cliSession, error) {
 		opts: *o,
 	}
 
+	if o.Timings {
+		c.timings = newSessionTimings()
+	}
+	if o.stats != "" {
+		c.stats = &transferStats{}
+	}
+	done := c.timings.track("kubeconfig")
+
 	err := c.prepClientConfig()
 	if err != nil {
 		return nil, err
@@ -81,41 +155,62 @@ func NewCliSession(o *Options) (*cliSession, error) {
 	if err != nil {
 		return nil, err
 	}
+	done()
 
 	return c, nil
 }
 
 func (c *cliSession) prepClientConfig() error {
-	var loadingRules *clientcmd.ClientConfigLoadingRules
-	switch c.opts.Kconfig {
-	case "":
-		loadingRules = clientcmd.NewDefaultClientConfigLoadingRules()
-	default:
-		loadingRules = &clientcmd.ClientConfigLoadingRules{
-			ExplicitPath: c.opts.Kconfig,
-		}
-	}
-
-	var ctxOverrides *clientcmd.ConfigOverrides
-	switch c.opts.Context {
-	case "":
-		ctxOverrides = &clientcmd.ConfigOverrides{}
-	default:
-		ctxOverrides = &clientcmd.ConfigOverrides{
-			CurrentContext: c.opts.Context,
-		}
+	// as with kubectl, an explicit --kubeconfig replaces $KUBECONFIG
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = c.opts.Kconfig
+
+	overrides := &clientcmd.ConfigOverrides{
+		CurrentContext: c.opts.Context,
+		Context: clientcmdapi.Context{
+			Cluster:  c.opts.cluster,
+			AuthInfo: c.opts.user,
+		},
+		ClusterInfo: clientcmdapi.Cluster{
+			Server:               c.opts.server,
+			CertificateAuthority: c.opts.caFile,
+			TLSServerName:        c.opts.tlsServerName,
+		},
+		AuthInfo: clientcmdapi.AuthInfo{
+			Token:             c.opts.token,
+			ClientCertificate: c.opts.clientCert,
+			ClientKey:         c.opts.clientKey,
+		},
+		Timeout: c.opts.requestTimeout,
 	}
 
 	c.clientConfig = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
 		loadingRules,
-		ctxOverrides,
+		overrides,
 	)
 
 	return nil
 }
 
 func (c *cliSession) prepRestConfig() error {
-	cc, err := c.clientConfig.ClientConfig()
+	var cc *rest.Config
+	var err error
+
+	c.inCluster = c.usingInClusterConfig()
+	if c.inCluster {
+		cc, err = c.inClusterConfig()
+	} else {
+		cc, err = c.clientConfig.ClientConfig()
+	}
+	noConfig := clientcmd.IsEmptyConfig(err)
+	if noConfig && c.opts.optionalConfig {
+		// nothing from the kubeconfig is used to connect elsewhere
+		klog.V(4).Info("No kubeconfig found, continuing without cluster credentials")
+		cc = &rest.Config{}
+		cc.Timeout, err = parseRequestTimeout(c.opts.requestTimeout)
+	} else if noConfig {
+		return errors.New("No kubeconfig found and not running in a pod, use --kubeconfig, $KUBECONFIG or --server")
+	}
 	if err != nil {
 		return err
 	}
@@ -123,20 +218,48 @@ func (c *cliSession) prepRestConfig() error {
 	if c.opts.Impersonate != "" {
 		cc.Impersonate = rest.ImpersonationConfig{
 			UserName: c.opts.Impersonate,
+			Groups:   c.opts.ImpersonateGrps,
+			UID:      c.opts.ImpersonateUID,
 		}
 		klog.V(4).Infof("Impersonating user: %s", c.opts.Impersonate)
+	} else if len(c.opts.ImpersonateGrps) > 0 || c.opts.ImpersonateUID != "" {
+		return errors.New("Impersonating groups or a uid requires --as")
+	}
+
+	if c.opts.proxy != "" {
+		proxyURL, err := parseProxyURL(c.opts.proxy)
+		if err != nil {
+			return err
+		}
+		cc.Proxy = http.ProxyURL(proxyURL)
+		klog.V(4).Infof("Using proxy: %s", proxyURL.Redacted())
+	}
+
+	dial, err := c.prepDial()
+	if err != nil {
+		return err
+	}
+	if dial != nil {
+		cc.Dial = dial
 	}
 
 	c.restConfig = cc
 
-	switch c.opts.Namespace {
-	case "":
-		c.namespace, _, err = c.clientConfig.Namespace()
+	switch {
+	case c.opts.Namespace != "":
+		c.namespace = c.opts.Namespace
+	case c.inCluster:
+		c.namespace, err = inClusterNamespace()
 		if err != nil {
 			return err
 		}
+	case noConfig:
+		c.namespace = metav1.NamespaceDefault
 	default:
-		c.namespace = c.opts.Namespace
+		c.namespace, _, err = c.clientConfig.Namespace()
+		if err != nil {
+			return err
+		}
 	}
 
 	if c.opts.noTLSVerify {
@@ -147,35 +270,83 @@ func (c *cliSession) prepRestConfig() error {
 
 	c.restConfig.UserAgent = fmt.Sprintf("kubectl-execws/%s", releaseVersion)
 
+	headers, err := c.prepHeaders()
+	if err != nil {
+		return err
+	}
+	if headers != nil {
+		c.restConfig.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return &headerRoundTripper{headers: headers, rt: rt}
+		})
+	}
+
+	if c.opts.tlsTimeout > 0 {
+		c.restConfig.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return &tlsTimeoutRoundTripper{timeout: c.opts.tlsTimeout, rt: rt}
+		})
+	}
+
+	if c.timings != nil {
+		c.restConfig.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return &credentialTimer{timings: c.timings, rt: rt}
+		})
+	}
+
+	return nil
+}
+
+// release any connections held for the session
+func (c *cliSession) Close() error {
+	if c.tunnel != nil {
+		return c.tunnel.Close()
+	}
 	return nil
 }
 
 func (c *cliSession) sanityCheck() error {
 	if !c.opts.noSanityCheck {
+		defer c.timings.track("pod lookup")()
+		c.timings.requestStarted()
 		res, err := c.k8sClient.CoreV1().Pods(c.namespace).Get(context.TODO(), c.opts.Pod, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
 		c.opts.PodSpec = res.Spec
+
+		// the kubelet knows static pods by their own uid, not that of the mirror pod
+		if uid, ok := res.Annotations[corev1.MirrorPodAnnotationKey]; ok && uid != "" {
+			c.podUID = uid
+			klog.V(4).Infof("Pod %s is a mirror of a static pod with uid %s", c.opts.Pod, uid)
+		}
 	}
 	return nil
 }
 
-func (c *cliSession) prepExec() (*http.Request, error) {
-	u, err := url.Parse(c.restConfig.Host)
+// convert the API server address to a websocket URL
+func websocketURL(host string) (*url.URL, error) {
+	u, err := url.Parse(host)
 	if err != nil {
 		return nil, err
 	}
 
 	switch u.Scheme {
-	case "https":
+	case "https", "wss":
 		u.Scheme = "wss"
-	case "http":
+	case "http", "ws":
 		u.Scheme = "ws"
 	default:
 		return nil, errors.New("Cannot determine websocket scheme")
 	}
 
+	return u, nil
+}
+
+func (c *cliSession) prepExec() (*http.Request, error) {
+	u, err := websocketURL(c.restConfig.Host)
+	if err != nil {
+		return nil, err
+	}
+
 	u.Path, err = url.JoinPath(u.Path, "api", "v1", "namespaces", c.namespace, "pods", c.opts.Pod, "exec")
 	if err != nil {
 		return nil, err
@@ -216,17 +387,34 @@ func (c *cliSession) prepExec() (*http.Request, error) {
 
 }
 
-// req -> ws callback
-func (c *cliSession) doExec(req *http.Request) error {
-	tlsConfig, err := rest.TLSConfigFor(c.restConfig)
+func (c *cliSession) newDialer(cfg *rest.Config) (*websocket.Dialer, error) {
+	tlsConfig, err := rest.TLSConfigFor(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	subprotocols := protocols
+	if len(c.opts.Protocols) > 0 {
+		subprotocols = c.opts.Protocols
+	}
+
+	// --tls-handshake-timeout is applied by cfg.Dial, HandshakeTimeout would
+	// also cover the connect, proxy & upgrade
 	dialer := &websocket.Dialer{
-		Proxy:           http.ProxyFromEnvironment,
+		Proxy:           loggingProxy(websocketProxy(effectiveProxy(cfg))),
+		NetDialContext:  cfg.Dial,
 		TLSClientConfig: tlsConfig,
-		Subprotocols:    protocols,
+		Subprotocols:    subprotocols,
+	}
+
+	return dialer, nil
+}
+
+// req -> ws callback
+func (c *cliSession) doExec(req *http.Request, cfg *rest.Config) error {
+	dialer, err := c.newDialer(cfg)
+	if err != nil {
+		return err
 	}
 
 	initState := &TerminalState{
@@ -246,16 +434,51 @@ func (c *cliSession) doExec(req *http.Request) error {
 	}
 
 	rt := &WebsocketRoundTripper{
-		Dialer:    dialer,
-		TermState: initState,
+		Dialer:     dialer,
+		TermState:  initState,
+		Stdin:      c.opts.Stdin,
+		Timings:    c.timings,
+		Stats:      c.stats,
+		LogPayload: c.opts.logPayloads,
+	}
+	if c.opts.compress {
+		rt.Compress = &compressionStats{}
+		dialer.EnableCompression = true
+		dialer.NetDialContext = rt.Compress.dial(dialer.NetDialContext)
+	}
+	if c.opts.dumpFrames != "" {
+		rt.Dump, err = newFrameDumper(c.opts.dumpFrames)
+		if err != nil {
+			return err
+		}
+		defer rt.Dump.Close()
 	}
 
-	rter, err := rest.HTTPWrappersForConfig(c.restConfig, rt)
+	rter, err := rest.HTTPWrappersForConfig(cfg, rt)
 	if err != nil {
 		return err
 	}
 
+	if trace := c.timings.clientTrace(); trace != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	}
+	c.timings.execStarted()
+	c.timings.requestStarted()
+
+	if c.opts.Transport == transportSPDY {
+		return c.doSPDYExec(req, cfg, initState)
+	}
+
 	_, err = rter.RoundTrip(req)
+	var upgradeErr *UpgradeError
+	if c.opts.Transport == transportAuto && errors.As(err, &upgradeErr) && upgradeErr.refused() {
+		klog.V(2).Infof("WebSocket upgrade refused with HTTP %d, falling back to SPDY", upgradeErr.StatusCode)
+		spdyErr := c.doSPDYExec(req, cfg, initState)
+		if spdyErr != nil {
+			return fmt.Errorf("%w, SPDY fallback failed: %s", err, spdyErr)
+		}
+		return nil
+	}
 	if err != nil {
 		return err
 
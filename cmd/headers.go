@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// parse curl style "Name: value" headers
+func parseHeaders(lines []string) (http.Header, error) {
+	headers := http.Header{}
+
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("Invalid header %q, must be 'Name: value'", redactHeader(line))
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+
+	return headers, nil
+}
+
+// one header per line, ignoring blank lines & # comments
+func readHeaderFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read headers: %w", err)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
+
+// header values are often credentials, so only ever log the name
+func redactHeader(line string) string {
+	name, _, ok := strings.Cut(line, ":")
+	if !ok {
+		return "<redacted>"
+	}
+	return name + ": <redacted>"
+}
+
+func (c *cliSession) prepHeaders() (http.Header, error) {
+	lines := c.opts.headers
+	if c.opts.headerFile != "" {
+		fileLines, err := readHeaderFile(c.opts.headerFile)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(fileLines, lines...)
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	headers, err := parseHeaders(lines)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	logRedaction.maskHeaders(names...)
+	klog.V(4).Infof("Adding request headers: %s", strings.Join(names, ", "))
+
+	return headers, nil
+}
+
+// headerRoundTripper adds user supplied headers to every request. It sits
+// inside the client-go debug round tripper, so the values are never logged.
+type headerRoundTripper struct {
+	headers http.Header
+	rt      http.RoundTripper
+}
+
+func (h *headerRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	for name, values := range h.headers {
+		// net/http takes the host from the request, the websocket dialer from the headers
+		if name == "Host" {
+			r.Host = values[0]
+		}
+		r.Header[name] = values
+	}
+	return h.rt.RoundTrip(r)
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		want    http.Header
+		wantErr bool
+	}{
+		{
+			name:  "canonicalised name & trimmed value",
+			lines: []string{"x-tenant:  blue "},
+			want:  http.Header{"X-Tenant": {"blue"}},
+		},
+		{
+			name:  "repeated header",
+			lines: []string{"X-Route: a", "x-route: b"},
+			want:  http.Header{"X-Route": {"a", "b"}},
+		},
+		{
+			name:  "colon in the value",
+			lines: []string{"Authorization: Basic dXNlcjpwYXNz", "X-Url: https://example.com:8443"},
+			want: http.Header{
+				"Authorization": {"Basic dXNlcjpwYXNz"},
+				"X-Url":         {"https://example.com:8443"},
+			},
+		},
+		{
+			name:  "empty value",
+			lines: []string{"X-Empty:"},
+			want:  http.Header{"X-Empty": {""}},
+		},
+		{
+			name:    "missing colon",
+			lines:   []string{"X-Tenant blue"},
+			wantErr: true,
+		},
+		{
+			name:    "empty name",
+			lines:   []string{": value"},
+			wantErr: true,
+		},
+		{
+			name:    "space in the name",
+			lines:   []string{"X Tenant: blue"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHeaders(tt.lines)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHeadersErrorIsRedacted(t *testing.T) {
+	_, err := parseHeaders([]string{"Bad Name: secret-token"})
+	if err == nil {
+		t.Fatal("want an error")
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("error %q includes the header value", err)
+	}
+}
+
+func TestReadHeaderFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "headers")
+	content := "# tenant routing\nX-Tenant: blue\n\n  X-Route: a  \n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readHeaderFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"X-Tenant: blue", "X-Route: a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
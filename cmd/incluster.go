@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+const (
+	serviceAccountTokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// running in a pod with a service account token, and no kubeconfig
+func (c *cliSession) usingInClusterConfig() bool {
+	if c.opts.server != "" {
+		return false
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" || os.Getenv("KUBERNETES_SERVICE_PORT") == "" {
+		return false
+	}
+	if fi, err := os.Stat(serviceAccountTokenFile); err != nil || fi.IsDir() {
+		return false
+	}
+
+	raw, err := c.clientConfig.RawConfig()
+	if err != nil {
+		return false
+	}
+	return len(raw.Clusters) == 0 && len(raw.Contexts) == 0
+}
+
+// the pod service account config, with the same connection flags applied as
+// for a kubeconfig. client-go has a fallback of its own, but it is skipped
+// when most of these are given.
+func (c *cliSession) inClusterConfig() (*rest.Config, error) {
+	klog.V(4).Info("No kubeconfig found, using in-cluster configuration")
+
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.opts.token != "" {
+		cfg.BearerToken = c.opts.token
+		cfg.BearerTokenFile = ""
+	}
+	if c.opts.caFile != "" {
+		cfg.TLSClientConfig.CAFile = c.opts.caFile
+	}
+	if c.opts.tlsServerName != "" {
+		cfg.TLSClientConfig.ServerName = c.opts.tlsServerName
+	}
+	if c.opts.clientCert != "" || c.opts.clientKey != "" {
+		cfg.TLSClientConfig.CertFile = c.opts.clientCert
+		cfg.TLSClientConfig.KeyFile = c.opts.clientKey
+	}
+
+	cfg.Timeout, err = parseRequestTimeout(c.opts.requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// from the downward API if set, else the service account namespace
+func inClusterNamespace() (string, error) {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to determine namespace: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// a duration, or a whole number of seconds, as kubectl accepts
+func parseRequestTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.Atoi(s); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid request timeout %q, must be a duration such as 1s, 2m or 3h", s)
+	}
+	return d, nil
+}
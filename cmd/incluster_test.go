@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRequestTimeout(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "30", want: 30 * time.Second},
+		{in: "500ms", want: 500 * time.Millisecond},
+		{in: "1m30s", want: 90 * time.Second},
+		{in: "2h", want: 2 * time.Hour},
+		{in: "-5", wantErr: true},
+		{in: "-1s", wantErr: true},
+		{in: "1.5", wantErr: true},
+		{in: "soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseRequestTimeout(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
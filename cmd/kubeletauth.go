@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// name of our extension in kubeconfig contexts & clusters
+const kubeconfigExtensionName = "kubectl-execws"
+
+type kubeconfigExtension struct {
+	Kubelet kubeletCredentials `json:"kubelet"`
+}
+
+type kubeletCredentials struct {
+	ClientCertificate    string `json:"client-certificate,omitempty"`
+	ClientKey            string `json:"client-key,omitempty"`
+	Token                string `json:"token,omitempty"`
+	CertificateAuthority string `json:"certificate-authority,omitempty"`
+	TLSServerName        string `json:"tls-server-name,omitempty"`
+}
+
+// fill any unset fields from another set of credentials
+func (k *kubeletCredentials) merge(o kubeletCredentials) {
+	if k.ClientCertificate == "" {
+		k.ClientCertificate = o.ClientCertificate
+	}
+	if k.ClientKey == "" {
+		k.ClientKey = o.ClientKey
+	}
+	if k.Token == "" {
+		k.Token = o.Token
+	}
+	if k.CertificateAuthority == "" {
+		k.CertificateAuthority = o.CertificateAuthority
+	}
+	if k.TLSServerName == "" {
+		k.TLSServerName = o.TLSServerName
+	}
+}
+
+// flags take precedence over the context extension, then the cluster extension
+func (c *cliSession) kubeletCredentials() (kubeletCredentials, error) {
+	creds := c.opts.kubeletCreds
+
+	raw, err := c.clientConfig.RawConfig()
+	if err != nil {
+		return creds, nil
+	}
+
+	ctxName := c.opts.Context
+	if ctxName == "" {
+		ctxName = raw.CurrentContext
+	}
+	ctx, ok := raw.Contexts[ctxName]
+	if !ok {
+		return creds, nil
+	}
+
+	ctxCreds, err := decodeKubeletExtension(ctx.Extensions[kubeconfigExtensionName], ctx.LocationOfOrigin)
+	if err != nil {
+		return creds, err
+	}
+	creds.merge(ctxCreds)
+
+	clusterName := ctx.Cluster
+	if c.opts.cluster != "" {
+		clusterName = c.opts.cluster
+	}
+	if cluster, ok := raw.Clusters[clusterName]; ok {
+		clusterCreds, err := decodeKubeletExtension(cluster.Extensions[kubeconfigExtensionName], cluster.LocationOfOrigin)
+		if err != nil {
+			return creds, err
+		}
+		creds.merge(clusterCreds)
+	}
+
+	return creds, nil
+}
+
+func decodeKubeletExtension(obj runtime.Object, origin string) (kubeletCredentials, error) {
+	var ext kubeconfigExtension
+
+	unknown, ok := obj.(*runtime.Unknown)
+	if !ok || len(unknown.Raw) == 0 {
+		return ext.Kubelet, nil
+	}
+
+	err := json.Unmarshal(unknown.Raw, &ext)
+	if err != nil {
+		return ext.Kubelet, fmt.Errorf("Unable to decode %s kubeconfig extension: %w", kubeconfigExtensionName, err)
+	}
+
+	// relative paths are relative to the kubeconfig file, as with the rest of kubeconfig
+	creds := &ext.Kubelet
+	for _, path := range []*string{&creds.ClientCertificate, &creds.ClientKey, &creds.CertificateAuthority} {
+		if *path != "" && !filepath.IsAbs(*path) && origin != "" {
+			*path = filepath.Join(filepath.Dir(origin), *path)
+		}
+	}
+
+	return *creds, nil
+}
+
+// rest config for talking to the kubelet, built from the API server config
+// with each kubelet credential replacing its counterpart. A kubelet CA or
+// server name alone still authenticates with the API server credentials.
+func (c *cliSession) kubeletRestConfig() (*rest.Config, error) {
+	creds, err := c.kubeletCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg *rest.Config
+	if creds.Token != "" || creds.ClientCertificate != "" || creds.ClientKey != "" {
+		klog.V(4).Info("Using dedicated kubelet credentials")
+		cfg = rest.AnonymousClientConfig(c.restConfig)
+		cfg.BearerToken = creds.Token
+		cfg.TLSClientConfig.CertFile = creds.ClientCertificate
+		cfg.TLSClientConfig.KeyFile = creds.ClientKey
+		cfg.WrapTransport = c.restConfig.WrapTransport
+	} else {
+		klog.V(4).Info("No kubelet credentials configured, reusing API server credentials")
+		cfg = rest.CopyConfig(c.restConfig)
+	}
+	cfg.Proxy = kubeletProxy(c.restConfig.Proxy)
+
+	if creds.CertificateAuthority != "" {
+		cfg.TLSClientConfig.CAFile = creds.CertificateAuthority
+		cfg.TLSClientConfig.CAData = nil
+	}
+
+	// kubelet serving certificates are issued for the node name, whatever
+	// name the API server certificate is verified against
+	cfg.TLSClientConfig.ServerName = creds.TLSServerName
+	if cfg.TLSClientConfig.ServerName == "" {
+		cfg.TLSClientConfig.ServerName = c.opts.PodSpec.NodeName
+	}
+
+	if c.opts.noTLSVerify {
+		cfg.TLSClientConfig.Insecure = true
+		cfg.TLSClientConfig.CAFile = ""
+		cfg.TLSClientConfig.CAData = nil
+	}
+
+	if serverName := cfg.TLSClientConfig.ServerName; serverName != "" && !cfg.TLSClientConfig.Insecure {
+		klog.V(4).Infof("Verifying kubelet certificate against server name %s", serverName)
+	}
+	return cfg, nil
+}
+
+// the environment proxy already honours NO_PROXY, make an explicit one do so too
+func kubeletProxy(proxy proxyFunc) proxyFunc {
+	if proxy == nil {
+		return nil
+	}
+	return withNoProxy(proxy)
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestKubeletRestConfig(t *testing.T) {
+	apiServer := &rest.Config{
+		Host:        "https://api.example.com:6443",
+		BearerToken: "api-token",
+		TLSClientConfig: rest.TLSClientConfig{
+			CertFile:   "api.crt",
+			KeyFile:    "api.key",
+			CAData:     []byte("api-ca"),
+			ServerName: "api.example.com",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		creds       kubeletCredentials
+		noTLSVerify bool
+		want        rest.Config
+	}{
+		{
+			name: "no kubelet credentials reuses the API server auth, verifying the node name",
+			want: rest.Config{
+				BearerToken: "api-token",
+				TLSClientConfig: rest.TLSClientConfig{
+					CertFile:   "api.crt",
+					KeyFile:    "api.key",
+					CAData:     []byte("api-ca"),
+					ServerName: "node1",
+				},
+			},
+		},
+		{
+			name:  "kubelet CA alone keeps the API server auth",
+			creds: kubeletCredentials{CertificateAuthority: "kubelet-ca.crt"},
+			want: rest.Config{
+				BearerToken: "api-token",
+				TLSClientConfig: rest.TLSClientConfig{
+					CertFile:   "api.crt",
+					KeyFile:    "api.key",
+					CAFile:     "kubelet-ca.crt",
+					ServerName: "node1",
+				},
+			},
+		},
+		{
+			name:  "kubelet server name alone keeps the API server auth",
+			creds: kubeletCredentials{TLSServerName: "node1.internal"},
+			want: rest.Config{
+				BearerToken: "api-token",
+				TLSClientConfig: rest.TLSClientConfig{
+					CertFile:   "api.crt",
+					KeyFile:    "api.key",
+					CAData:     []byte("api-ca"),
+					ServerName: "node1.internal",
+				},
+			},
+		},
+		{
+			name:  "kubelet token replaces all API server auth",
+			creds: kubeletCredentials{Token: "kubelet-token"},
+			want: rest.Config{
+				BearerToken: "kubelet-token",
+				TLSClientConfig: rest.TLSClientConfig{
+					CAData:     []byte("api-ca"),
+					ServerName: "node1",
+				},
+			},
+		},
+		{
+			name:  "kubelet client certificate replaces all API server auth",
+			creds: kubeletCredentials{ClientCertificate: "kubelet.crt", ClientKey: "kubelet.key", CertificateAuthority: "kubelet-ca.crt"},
+			want: rest.Config{
+				TLSClientConfig: rest.TLSClientConfig{
+					CertFile:   "kubelet.crt",
+					KeyFile:    "kubelet.key",
+					CAFile:     "kubelet-ca.crt",
+					ServerName: "node1",
+				},
+			},
+		},
+		{
+			name:        "skipping verification drops any CA",
+			creds:       kubeletCredentials{CertificateAuthority: "kubelet-ca.crt"},
+			noTLSVerify: true,
+			want: rest.Config{
+				BearerToken: "api-token",
+				TLSClientConfig: rest.TLSClientConfig{
+					Insecure:   true,
+					CertFile:   "api.crt",
+					KeyFile:    "api.key",
+					ServerName: "node1",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &cliSession{
+				opts: Options{
+					kubeletCreds: tt.creds,
+					noTLSVerify:  tt.noTLSVerify,
+					PodSpec:      corev1.PodSpec{NodeName: "node1"},
+				},
+				clientConfig: clientcmd.NewDefaultClientConfig(*clientcmdapi.NewConfig(), nil),
+				restConfig:   apiServer,
+			}
+
+			got, err := c.kubeletRestConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.BearerToken != tt.want.BearerToken {
+				t.Errorf("got token %q, want %q", got.BearerToken, tt.want.BearerToken)
+			}
+			gotTLS, wantTLS := got.TLSClientConfig, tt.want.TLSClientConfig
+			if gotTLS.Insecure != wantTLS.Insecure || gotTLS.CertFile != wantTLS.CertFile || gotTLS.KeyFile != wantTLS.KeyFile ||
+				gotTLS.CAFile != wantTLS.CAFile || string(gotTLS.CAData) != string(wantTLS.CAData) || gotTLS.ServerName != wantTLS.ServerName {
+				t.Errorf("got TLS config %+v, want %+v", gotTLS, wantTLS)
+			}
+		})
+	}
+}
@@ -4,50 +4,106 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/moby/term"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 )
 
-func (c *cliSession) getNodeIP() (string, error) {
-	var ip string
+const (
+	directExecOff     = "false"
+	directExecKubelet = "true"
+	directExecProxy   = "proxy"
+	directExecAuto    = "auto"
+)
+
+func validateDirectExec(mode string) error {
+	switch mode {
+	case directExecOff, directExecKubelet, directExecProxy, directExecAuto:
+		return nil
+	}
+	return fmt.Errorf("Unknown direct-exec mode %q, must be one of true, false, proxy or auto", mode)
+}
+
+const defaultKubeletPort = 10250
+
+var defaultKubeletAddressTypes = []string{
+	string(corev1.NodeInternalIP),
+	string(corev1.NodeExternalIP),
+	string(corev1.NodeHostName),
+	string(corev1.NodeInternalDNS),
+}
+
+// get the host:port of the kubelet running the pod
+func (c *cliSession) getKubeletAddress() (string, error) {
+	port := c.opts.kubeletPort
 
-	if c.opts.directExecNodeIp != "" {
-		return c.opts.directExecNodeIp, nil
+	switch {
+	case c.nodeIP != "":
+		return c.kubeletHostPort(c.nodeIP), nil
+	case len(c.opts.directExecIps) == 1:
+		return c.kubeletHostPort(c.opts.directExecIps[0]), nil
+	case len(c.opts.directExecIps) > 1:
+		return "", errors.New("Cannot determine which node IP to use")
 	}
 
+	defer c.timings.track("node lookup")()
+	c.timings.requestStarted()
 	res, err := c.k8sClient.CoreV1().Nodes().Get(context.TODO(), c.opts.PodSpec.NodeName, metav1.GetOptions{})
 	if err != nil {
 		return "", err
 	}
 
-	for _, addr := range res.Status.Addresses {
-		if addr.Type == "InternalIP" {
-			ip = addr.Address
-		}
+	host, err := nodeAddress(res, c.opts.kubeletAddrTypes)
+	if err != nil {
+		return "", err
 	}
 
-	if ip == "" {
-		return "", errors.New("Unable to find Node IP")
+	if port == 0 {
+		port = int(res.Status.DaemonEndpoints.KubeletEndpoint.Port)
+	}
+	if port == 0 {
+		port = defaultKubeletPort
 	}
 
-	return ip, nil
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
 }
 
-func (c *cliSession) prepKubeletExec() (*http.Request, error) {
-	nodeIP, err := c.getNodeIP()
-	if err != nil {
-		return nil, err
+// host:port for a user supplied node IP
+func (c *cliSession) kubeletHostPort(ip string) string {
+	port := c.opts.kubeletPort
+	if port == 0 {
+		port = defaultKubeletPort
 	}
+	return net.JoinHostPort(strings.Trim(ip, "[]"), strconv.Itoa(port))
+}
 
-	u, err := url.Parse(fmt.Sprintf("wss://%s:10250", nodeIP))
-	if err != nil {
-		return nil, err
+// first address of the most preferred type the node has
+func nodeAddress(node *corev1.Node, addrTypes []string) (string, error) {
+	if len(addrTypes) == 0 {
+		addrTypes = defaultKubeletAddressTypes
 	}
 
+	for _, addrType := range addrTypes {
+		for _, addr := range node.Status.Addresses {
+			if string(addr.Type) == addrType {
+				klog.V(4).Infof("Using %s address of node %s: %s", addr.Type, node.Name, addr.Address)
+				return addr.Address, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("Unable to find a node address of type %s", strings.Join(addrTypes, ", "))
+}
+
+// kubelet API path of a container, eg. exec/<ns>/<pod>/<ctr>
+func (c *cliSession) kubeletContainerPath(endpoint string) (string, error) {
 	var ctrName string
 	if c.opts.Container != "" {
 		ctrName = c.opts.Container
@@ -55,12 +111,23 @@ func (c *cliSession) prepKubeletExec() (*http.Request, error) {
 		ctrName = c.opts.PodSpec.Containers[0].Name
 		klog.V(4).Infof("Discovered container name: %s", ctrName)
 	} else {
-		return nil, errors.New("Cannot determine container name")
+		return "", errors.New("Cannot determine container name")
 	}
 
-	u.Path, err = url.JoinPath("exec", c.namespace, c.opts.Pod, ctrName)
+	// the uid is optional, but pins the exact pod when known
+	elems := []string{c.namespace, c.opts.Pod, ctrName}
+	if c.podUID != "" {
+		elems = []string{c.namespace, c.opts.Pod, c.podUID, ctrName}
+	}
+
+	return url.JoinPath(endpoint, elems...)
+}
+
+// exec path and query understood by the kubelet API
+func (c *cliSession) kubeletExecPath() (string, url.Values, error) {
+	path, err := c.kubeletContainerPath("exec")
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
 	query := url.Values{}
@@ -83,14 +150,125 @@ func (c *cliSession) prepKubeletExec() (*http.Request, error) {
 	if c.opts.Stdin {
 		query.Add("input", "1")
 	}
+
+	return path, query, nil
+}
+
+// without the preflight request, ask the kubelets where the pod is when needed
+func (c *cliSession) maybeDiscoverKubeletPod() error {
+	if c.opts.noSanityCheck && (c.opts.Container == "" || len(c.opts.directExecIps) > 1) {
+		return c.discoverKubeletPod()
+	}
+	return nil
+}
+
+func (c *cliSession) prepKubeletExec() (*http.Request, error) {
+	err := c.maybeDiscoverKubeletPod()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := c.getKubeletAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(fmt.Sprintf("wss://%s", addr))
+	if err != nil {
+		return nil, err
+	}
+
+	path, query, err := c.kubeletExecPath()
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path
 	u.RawQuery = query.Encode()
 
 	req, err := http.NewRequest(http.MethodGet, u.String(), http.NoBody)
 	if err != nil {
 		return nil, err
 	}
-	klog.V(7).Infof("Making request to kubelet API: %s:10250%s", nodeIP, u.RequestURI())
+	klog.V(7).Infof("Making request to kubelet API: %s%s", addr, u.RequestURI())
 
 	return req, nil
 
 }
+
+// reach the kubelet exec endpoint through the API server node proxy
+func (c *cliSession) prepNodeProxyExec() (*http.Request, error) {
+	if c.opts.PodSpec.NodeName == "" {
+		return nil, errors.New("Cannot determine node name")
+	}
+
+	u, err := websocketURL(c.restConfig.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	path, query, err := c.kubeletExecPath()
+	if err != nil {
+		return nil, err
+	}
+
+	u.Path, err = url.JoinPath(u.Path, "api", "v1", "nodes", c.opts.PodSpec.NodeName, "proxy", path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(7).Infof("Making request to kubelet API via node proxy: %s", u.RequestURI())
+
+	return req, nil
+}
+
+// exec via the API server, retrying direct to the kubelet when that path is blocked
+func (c *cliSession) doAutoExec() error {
+	req, err := c.prepExec()
+	if err != nil {
+		return err
+	}
+
+	klog.V(4).Info("Trying exec via the API server")
+	err = c.doExec(req, c.restConfig)
+	if !shouldFallbackToKubelet(err) {
+		return err
+	}
+	klog.V(2).Infof("Exec via the API server failed (%s), retrying via the kubelet API", err)
+
+	req, err = c.prepKubeletExec()
+	if err != nil {
+		return err
+	}
+	klog.V(2).Infof("Using the kubelet API at %s", req.URL.Host)
+
+	cfg, err := c.kubeletRestConfig()
+	if err != nil {
+		return err
+	}
+
+	return c.doExec(req, cfg)
+}
+
+// failures where the kubelet API may succeed: webhook denials, refused
+// upgrades & errors from the API server or an aggregator in front of it
+func shouldFallbackToKubelet(err error) bool {
+	var upgradeErr *UpgradeError
+	if !errors.As(err, &upgradeErr) {
+		return false
+	}
+
+	switch {
+	case upgradeErr.StatusCode >= 500:
+		return true
+	case upgradeErr.StatusCode == http.StatusBadRequest, upgradeErr.StatusCode == http.StatusUpgradeRequired:
+		return true
+	case strings.Contains(upgradeErr.Error(), "admission webhook"):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestNodeAddress(t *testing.T) {
+	node := &corev1.Node{
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeHostName, Address: "node1"},
+				{Type: corev1.NodeExternalIP, Address: "203.0.113.1"},
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+				{Type: corev1.NodeInternalIP, Address: "fd00::1"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		addrTypes []string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name: "internal address preferred by default",
+			want: "10.0.0.1",
+		},
+		{
+			name:      "first matching type wins over listing order",
+			addrTypes: []string{"ExternalIP", "InternalIP"},
+			want:      "203.0.113.1",
+		},
+		{
+			name:      "falls through to a later type",
+			addrTypes: []string{"ExternalDNS", "Hostname"},
+			want:      "node1",
+		},
+		{
+			name:      "no address of any type",
+			addrTypes: []string{"InternalDNS"},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nodeAddress(node, tt.addrTypes)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeletHostPort(t *testing.T) {
+	tests := []struct {
+		ip   string
+		port int
+		want string
+	}{
+		{ip: "10.0.0.1", want: "10.0.0.1:10250"},
+		{ip: "10.0.0.1", port: 10255, want: "10.0.0.1:10255"},
+		{ip: "fd00::1", want: "[fd00::1]:10250"},
+		{ip: "[fd00::1]", want: "[fd00::1]:10250"},
+	}
+
+	for _, tt := range tests {
+		c := &cliSession{opts: Options{kubeletPort: tt.port}}
+		if got := c.kubeletHostPort(tt.ip); got != tt.want {
+			t.Errorf("kubeletHostPort(%q) with port %d: got %q, want %q", tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestShouldFallbackToKubelet(t *testing.T) {
+	upgradeErr := func(status int, msg string) error {
+		return &UpgradeError{StatusCode: status, Err: errors.New(msg)}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection error", err: errors.New("Error connecting to 10.0.0.1:443, connection refused")},
+		{name: "server error", err: upgradeErr(http.StatusInternalServerError, "Error from server"), want: true},
+		{name: "bad gateway from an aggregator", err: upgradeErr(http.StatusBadGateway, "Error from server"), want: true},
+		{name: "refused upgrade", err: upgradeErr(http.StatusBadRequest, "Upgrade request required"), want: true},
+		{name: "upgrade required", err: upgradeErr(http.StatusUpgradeRequired, "Error from server"), want: true},
+		{
+			name: "webhook denial",
+			err:  upgradeErr(http.StatusForbidden, `Error from server (Forbidden): admission webhook "deny-exec.example.com" denied the request`),
+			want: true,
+		},
+		{name: "rbac denial", err: upgradeErr(http.StatusForbidden, "Error from server (Forbidden): pods \"p\" is forbidden")},
+		{name: "unauthorized", err: upgradeErr(http.StatusUnauthorized, "Error from server (Unauthorized)")},
+		{name: "pod not found", err: upgradeErr(http.StatusNotFound, "Error from server (NotFound)")},
+		{name: "wrapped", err: fmt.Errorf("exec failed: %w", upgradeErr(http.StatusServiceUnavailable, "unavailable")), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldFallbackToKubelet(tt.err); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+type kubeletPodMatch struct {
+	NodeIP string
+	Pod    corev1.Pod
+}
+
+// list pods from the kubelet itself, for when the API server can't be used
+func (c *cliSession) kubeletPods(addr string) (*corev1.PodList, error) {
+	cfg, err := c.kubeletRestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := rest.HTTPClientFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	u := url.URL{Scheme: "https", Host: addr, Path: "/pods"}
+	klog.V(7).Infof("Making request to kubelet API: %s", u.String())
+
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("Error from kubelet (%d): %s", resp.StatusCode, body)
+	}
+
+	var pods corev1.PodList
+	err = json.NewDecoder(resp.Body).Decode(&pods)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode pod list from kubelet: %w", err)
+	}
+
+	return &pods, nil
+}
+
+// find the node, namespace, uid & containers of the pod by asking each kubelet
+func (c *cliSession) discoverKubeletPod() error {
+	defer c.timings.track("pod discovery")()
+
+	var matches []kubeletPodMatch
+	for _, ip := range c.opts.directExecIps {
+		addr := c.kubeletHostPort(ip)
+		pods, err := c.kubeletPods(addr)
+		if err != nil {
+			klog.V(2).Infof("Unable to list pods on %s: %s", addr, err)
+			continue
+		}
+
+		for _, pod := range pods.Items {
+			if pod.Name != c.opts.Pod {
+				continue
+			}
+			if c.opts.Namespace != "" && pod.Namespace != c.opts.Namespace {
+				continue
+			}
+			matches = append(matches, kubeletPodMatch{NodeIP: ip, Pod: pod})
+		}
+	}
+
+	// without an explicit namespace, prefer the kubeconfig one if it matches
+	if len(matches) > 1 {
+		var preferred []kubeletPodMatch
+		for _, m := range matches {
+			if m.Pod.Namespace == c.namespace {
+				preferred = append(preferred, m)
+			}
+		}
+		if len(preferred) > 0 {
+			matches = preferred
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("Unable to find pod %s on nodes %s", c.opts.Pod, strings.Join(c.opts.directExecIps, ", "))
+	case 1:
+	default:
+		var found []string
+		for _, m := range matches {
+			found = append(found, fmt.Sprintf("%s/%s on %s", m.Pod.Namespace, m.Pod.Name, m.NodeIP))
+		}
+		return fmt.Errorf("Found multiple pods named %s, please specify namespace: %s", c.opts.Pod, strings.Join(found, ", "))
+	}
+
+	m := matches[0]
+	c.nodeIP = m.NodeIP
+	c.namespace = m.Pod.Namespace
+	c.podUID = string(m.Pod.UID)
+	c.opts.PodSpec = m.Pod.Spec
+	klog.V(4).Infof("Discovered pod %s/%s (uid %s) on %s", c.namespace, c.opts.Pod, c.podUID, c.nodeIP)
+
+	return nil
+}
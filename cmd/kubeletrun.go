@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/moby/term"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// run a non-interactive command with a single POST to the kubelet /run endpoint
+func (c *cliSession) doKubeletRun() error {
+	// the kubelet splits the cmd parameter on spaces to build the argv
+	for _, arg := range c.opts.Command {
+		if strings.ContainsAny(arg, " \t\n") {
+			return errors.New("Command arguments cannot contain whitespace when using the kubelet run endpoint")
+		}
+	}
+
+	err := c.maybeDiscoverKubeletPod()
+	if err != nil {
+		return err
+	}
+
+	addr, err := c.getKubeletAddress()
+	if err != nil {
+		return err
+	}
+
+	path, err := c.kubeletContainerPath("run")
+	if err != nil {
+		return err
+	}
+
+	cfg, err := c.kubeletRestConfig()
+	if err != nil {
+		return err
+	}
+
+	client, err := rest.HTTPClientFor(cfg)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Add("cmd", strings.Join(c.opts.Command, " "))
+	u := url.URL{Scheme: "https", Host: addr, Path: "/" + path, RawQuery: query.Encode()}
+	klog.V(7).Infof("Making request to kubelet API: %s%s", addr, u.RequestURI())
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	c.timings.execStarted()
+	c.timings.requestStarted()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Error from kubelet (%d): %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	c.timings.outputReceived()
+
+	_, stdOut, _ := term.StdStreams()
+	_, err = io.Copy(stdOut, resp.Body)
+	return err
+}
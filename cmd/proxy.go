@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+type proxyFunc func(*http.Request) (*url.URL, error)
+
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy URL %s, missing host", u.Redacted())
+	}
+
+	// schemes understood by client-go, see websocketProxy for socks5h
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("Unknown proxy scheme %q, must be one of http, socks5 or socks5h", u.Scheme)
+}
+
+// the proxy for a config, from --proxy or the kubeconfig proxy-url, else the environment
+func effectiveProxy(cfg *rest.Config) proxyFunc {
+	if cfg.Proxy != nil {
+		return cfg.Proxy
+	}
+	return http.ProxyFromEnvironment
+}
+
+// gorilla/websocket only knows socks5, but like net/http it passes hostnames
+// to the proxy to resolve, so socks5h can be sent as socks5 without DNS moving
+// to this end of the connection
+func websocketProxy(proxy proxyFunc) proxyFunc {
+	return func(r *http.Request) (*url.URL, error) {
+		u, err := proxy(r)
+		if u != nil && u.Scheme == "socks5h" {
+			socks5 := *u
+			socks5.Scheme = "socks5"
+			return &socks5, err
+		}
+		return u, err
+	}
+}
+
+// log which proxy, if any, each connection is made through
+func loggingProxy(proxy proxyFunc) proxyFunc {
+	return func(r *http.Request) (*url.URL, error) {
+		u, err := proxy(r)
+		if u != nil {
+			klog.V(4).Infof("Connecting to %s via proxy %s", r.URL.Host, u.Redacted())
+		}
+		return u, err
+	}
+}
+
+// an explicit proxy is still bypassed for hosts matching NO_PROXY, as node
+// IPs are often reachable directly when the API server is not
+func withNoProxy(proxy proxyFunc) proxyFunc {
+	noProxy := httpproxy.FromEnvironment().NoProxy
+	if noProxy == "" {
+		return proxy
+	}
+
+	// any proxy will do here, we only care whether the host is excluded
+	check := (&httpproxy.Config{
+		HTTPProxy:  "http://proxy",
+		HTTPSProxy: "http://proxy",
+		NoProxy:    noProxy,
+	}).ProxyFunc()
+
+	return func(r *http.Request) (*url.URL, error) {
+		u, err := check(r.URL)
+		if err == nil && u == nil {
+			klog.V(4).Infof("Not proxying connection to %s, matched by NO_PROXY", r.URL.Host)
+			return nil, nil
+		}
+		return proxy(r)
+	}
+}
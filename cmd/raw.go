@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/moby/term"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// request & config for a user supplied channel.k8s.io endpoint
+func (c *cliSession) prepRawExec(rawURL string) (*http.Request, *rest.Config, error) {
+	if !strings.Contains(rawURL, "://") {
+		return nil, nil, errors.New("URL must include a scheme, eg. wss://host/path")
+	}
+	u, err := websocketURL(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.opts.TTY {
+		stdIn, _, _ := term.StdStreams()
+		_, c.RawMode = term.GetFdInfo(stdIn)
+		if !c.RawMode {
+			klog.V(2).Infof("Unable to use a TTY - input is not a terminal or the right kind of file")
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return req, c.rawRestConfig(req), nil
+}
+
+// kubeconfig credentials are only sent to the API server they belong to
+func (c *cliSession) rawRestConfig(req *http.Request) *rest.Config {
+	api, err := websocketURL(c.restConfig.Host)
+	if err == nil && api.Scheme == req.URL.Scheme && api.Host == req.URL.Host {
+		return c.restConfig
+	}
+	klog.V(2).Infof("%s is not the API server, not sending kubeconfig credentials", req.URL.Host)
+
+	cfg := rest.AnonymousClientConfig(c.restConfig)
+	cfg.TLSClientConfig.ServerName = ""
+	// the cluster CA would replace the system roots, which publicly trusted
+	// endpoints are verified against
+	cfg.TLSClientConfig.CAData = nil
+	cfg.TLSClientConfig.CAFile = ""
+	if !cfg.TLSClientConfig.Insecure {
+		cfg.TLSClientConfig.CAFile = c.opts.caFile
+	}
+	cfg.WrapTransport = c.restConfig.WrapTransport
+	return cfg
+}
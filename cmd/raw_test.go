@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"net/http"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestRawRestConfig(t *testing.T) {
+	api := &rest.Config{
+		Host:        "https://api.example.com:6443",
+		BearerToken: "secret",
+		TLSClientConfig: rest.TLSClientConfig{
+			ServerName: "kubernetes",
+			CAData:     []byte("cluster ca"),
+			CAFile:     "/cluster/ca.crt",
+		},
+	}
+
+	tests := []struct {
+		name       string
+		url        string
+		caFile     string
+		insecure   bool
+		wantAPI    bool
+		wantCAFile string
+	}{
+		{
+			name:    "API server keeps the kubeconfig",
+			url:     "wss://api.example.com:6443/api/v1/namespaces/default/pods/p/exec",
+			wantAPI: true,
+		},
+		{
+			name: "other host drops credentials & the cluster CA",
+			url:  "wss://proxy.example.com/exec",
+		},
+		{
+			name: "other port is another host",
+			url:  "wss://api.example.com:8443/exec",
+		},
+		{
+			name:       "certificate authority flag is used for other hosts",
+			url:        "wss://proxy.example.com/exec",
+			caFile:     "/flag/ca.crt",
+			wantCAFile: "/flag/ca.crt",
+		},
+		{
+			name:     "insecure drops the certificate authority flag",
+			url:      "wss://proxy.example.com/exec",
+			caFile:   "/flag/ca.crt",
+			insecure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := rest.CopyConfig(api)
+			cc.Insecure = tt.insecure
+			c := &cliSession{opts: Options{caFile: tt.caFile}, restConfig: cc}
+
+			req, err := http.NewRequest(http.MethodGet, tt.url, http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := c.rawRestConfig(req)
+
+			if tt.wantAPI {
+				if got != cc {
+					t.Error("got a new config for the API server")
+				}
+				return
+			}
+			if got.BearerToken != "" {
+				t.Error("bearer token sent to another host")
+			}
+			if got.ServerName != "" {
+				t.Errorf("got server name %q, want none", got.ServerName)
+			}
+			if got.CAData != nil {
+				t.Error("cluster CA data used for another host")
+			}
+			if got.CAFile != tt.wantCAFile {
+				t.Errorf("got CA file %q, want %q", got.CAFile, tt.wantCAFile)
+			}
+		})
+	}
+}
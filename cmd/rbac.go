@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	authv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+type accessCheck struct {
+	Verb        string
+	Resource    string
+	Subresource string
+	Namespace   string
+	Name        string
+}
+
+type accessResult struct {
+	Check   accessCheck
+	Allowed bool
+	Reason  string
+}
+
+func (a accessCheck) String() string {
+	res := a.Resource
+	if a.Subresource != "" {
+		res = fmt.Sprintf("%s/%s", a.Resource, a.Subresource)
+	}
+	if a.Name != "" {
+		res = fmt.Sprintf("%s %s", res, a.Name)
+	}
+	if a.Namespace != "" {
+		return fmt.Sprintf("%s %s (namespace %s)", a.Verb, res, a.Namespace)
+	}
+	return fmt.Sprintf("%s %s", a.Verb, res)
+}
+
+// permissions needed for the configured exec path
+func (c *cliSession) accessChecks() []accessCheck {
+	checks := []accessCheck{}
+
+	if !c.opts.noSanityCheck {
+		checks = append(checks, accessCheck{Verb: "get", Resource: "pods", Namespace: c.namespace, Name: c.opts.Pod})
+	}
+
+	nodeName := c.opts.PodSpec.NodeName
+	direct := c.opts.directExec == directExecKubelet || c.opts.directExec == directExecProxy
+	if direct && nodeName == "" {
+		// checking every node would report a denial the exec won't hit
+		klog.V(2).Info("Node of the pod is unknown, not checking node permissions")
+		return checks
+	}
+
+	switch c.opts.directExec {
+	case directExecKubelet:
+		if len(c.opts.directExecIps) == 0 {
+			checks = append(checks, accessCheck{Verb: "get", Resource: "nodes", Name: nodeName})
+		}
+		// the kubelet authorises a websocket GET as the get verb, and the
+		// POST to the run endpoint as create
+		verb := "get"
+		if c.opts.kubeletRun {
+			verb = "create"
+		}
+		checks = append(checks, accessCheck{Verb: verb, Resource: "nodes", Subresource: "proxy", Name: nodeName})
+	case directExecProxy:
+		checks = append(checks, accessCheck{Verb: "get", Resource: "nodes", Subresource: "proxy", Name: nodeName})
+	default:
+		// auto only needs the kubelet path when the API server path fails
+		checks = append(checks, accessCheck{Verb: "create", Resource: "pods", Subresource: "exec", Namespace: c.namespace, Name: c.opts.Pod})
+	}
+
+	return checks
+}
+
+// issue a SelfSubjectAccessReview per check, as the effective (possibly impersonated) user
+func (c *cliSession) checkAccess() ([]accessResult, error) {
+	var results []accessResult
+
+	for _, check := range c.accessChecks() {
+		review := &authv1.SelfSubjectAccessReview{
+			Spec: authv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authv1.ResourceAttributes{
+					Namespace:   check.Namespace,
+					Verb:        check.Verb,
+					Resource:    check.Resource,
+					Subresource: check.Subresource,
+					Name:        check.Name,
+				},
+			},
+		}
+
+		res, err := c.k8sClient.AuthorizationV1().SelfSubjectAccessReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to review access for %s: %w", check, err)
+		}
+		klog.V(4).Infof("Access review for %s: allowed=%t", check, res.Status.Allowed)
+
+		reason := res.Status.Reason
+		if res.Status.EvaluationError != "" {
+			reason = res.Status.EvaluationError
+		}
+		results = append(results, accessResult{
+			Check:   check,
+			Allowed: res.Status.Allowed,
+			Reason:  reason,
+		})
+	}
+
+	return results, nil
+}
+
+func (c *cliSession) rbacPreflight() error {
+	results, err := c.checkAccess()
+	if err != nil {
+		return err
+	}
+
+	var denied []string
+	for _, r := range results {
+		if !r.Allowed {
+			denied = append(denied, r.Check.String())
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("Insufficient permissions, not allowed to: %s", strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+func printAccessResults(w io.Writer, results []accessResult) {
+	for _, r := range results {
+		answer := "yes"
+		if !r.Allowed {
+			answer = "no"
+		}
+		if r.Reason != "" {
+			fmt.Fprintf(w, "%-4s %s - %s\n", answer, r.Check, r.Reason)
+		} else {
+			fmt.Fprintf(w, "%-4s %s\n", answer, r.Check)
+		}
+	}
+}
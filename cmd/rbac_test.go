@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestAccessChecks(t *testing.T) {
+	podGet := "get pods p (namespace ns)"
+	tests := []struct {
+		name        string
+		opts        Options
+		unknownNode bool
+		want        []string
+	}{
+		{
+			name: "API server exec",
+			want: []string{podGet, "create pods/exec p (namespace ns)"},
+		},
+		{
+			name: "no sanity check",
+			opts: Options{noSanityCheck: true},
+			want: []string{"create pods/exec p (namespace ns)"},
+		},
+		{
+			name: "direct exec looks up the node",
+			opts: Options{directExec: directExecKubelet},
+			want: []string{podGet, "get nodes node1", "get nodes/proxy node1"},
+		},
+		{
+			name: "direct exec with a node IP",
+			opts: Options{directExec: directExecKubelet, directExecIps: []string{"10.0.0.1"}},
+			want: []string{podGet, "get nodes/proxy node1"},
+		},
+		{
+			name: "direct run posts to the kubelet",
+			opts: Options{directExec: directExecKubelet, kubeletRun: true},
+			want: []string{podGet, "get nodes node1", "create nodes/proxy node1"},
+		},
+		{
+			name:        "unknown node skips the node checks",
+			opts:        Options{directExec: directExecKubelet, directExecIps: []string{"10.0.0.1"}},
+			unknownNode: true,
+			want:        []string{podGet},
+		},
+		{
+			name: "node proxy",
+			opts: Options{directExec: directExecProxy},
+			want: []string{podGet, "get nodes/proxy node1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Pod = "p"
+			if !tt.unknownNode {
+				tt.opts.PodSpec = corev1.PodSpec{NodeName: "node1"}
+			}
+			c := &cliSession{opts: tt.opts, namespace: "ns"}
+
+			var got []string
+			for _, check := range c.accessChecks() {
+				got = append(got, check.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
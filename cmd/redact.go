@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// headers masked in every log line, along with any given with -H
+var redactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+var (
+	bearerTokenPattern = regexp.MustCompile(`(?i)\b(bearer\s+)[^\s"'<>]+`)
+	urlPasswordPattern = regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`)
+)
+
+// logRedactor is installed as the klog filter, so credentials are masked in
+// all log output, including client-go's request & curl debug logging
+type logRedactor struct {
+	mu            sync.RWMutex
+	headerNames   map[string]bool
+	headerPattern *regexp.Regexp
+}
+
+var logRedaction = newLogRedactor()
+
+func newLogRedactor() *logRedactor {
+	r := &logRedactor{
+		headerNames: map[string]bool{},
+	}
+	r.maskHeaders(redactedHeaders...)
+	return r
+}
+
+// mask the values of these headers wherever they are logged as "Name: value"
+func (r *logRedactor) maskHeaders(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, name := range names {
+		r.headerNames[strings.ToLower(name)] = true
+	}
+
+	var quoted []string
+	for name := range r.headerNames {
+		quoted = append(quoted, regexp.QuoteMeta(name))
+	}
+	r.headerPattern = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)(\s*:\s*)[^"\r\n]*`)
+}
+
+func (r *logRedactor) redact(s string) string {
+	r.mu.RLock()
+	headers := r.headerPattern
+	r.mu.RUnlock()
+
+	s = headers.ReplaceAllString(s, "${1}${2}<masked>")
+	s = bearerTokenPattern.ReplaceAllString(s, "${1}<masked>")
+	s = urlPasswordPattern.ReplaceAllString(s, "${1}<masked>@")
+	return s
+}
+
+func (r *logRedactor) redactArgs(args []interface{}) []interface{} {
+	redacted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			redacted[i] = r.redact(v)
+		case error, fmt.Stringer:
+			redacted[i] = r.redact(fmt.Sprint(v))
+		default:
+			redacted[i] = arg
+		}
+	}
+	return redacted
+}
+
+func (r *logRedactor) Filter(args []interface{}) []interface{} {
+	return r.redactArgs(args)
+}
+
+// format first, so values split across a format string & args are masked
+func (r *logRedactor) FilterF(format string, args []interface{}) (string, []interface{}) {
+	return "%s", []interface{}{r.redact(fmt.Sprintf(format, args...))}
+}
+
+func (r *logRedactor) FilterS(msg string, keysAndValues []interface{}) (string, []interface{}) {
+	return r.redact(msg), r.redactArgs(keysAndValues)
+}
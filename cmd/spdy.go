@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/moby/term"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+	"k8s.io/klog/v2"
+)
+
+const (
+	transportWebsocket = "websocket"
+	transportSPDY      = "spdy"
+	transportAuto      = "auto"
+)
+
+// exec over SPDY with client-go, for servers that refuse the websocket upgrade
+func (c *cliSession) doSPDYExec(req *http.Request, cfg *rest.Config, termState *TerminalState) error {
+	u := *req.URL
+	switch u.Scheme {
+	case "wss":
+		u.Scheme = "https"
+	case "ws":
+		u.Scheme = "http"
+	}
+
+	executor, err := c.newSPDYExecutor(cfg, &u)
+	if err != nil {
+		return err
+	}
+
+	stdIn, stdOut, stdErr := term.StdStreams()
+	opts := remotecommand.StreamOptions{
+		Stdout: stdOut,
+		Stderr: stdErr,
+		Tty:    c.RawMode,
+	}
+	if c.opts.Stdin {
+		opts.Stdin = stdIn
+	}
+	if c.RawMode {
+		opts.TerminalSizeQueue = &terminalSizeQueue{
+			state:  termState,
+			notify: registerResizeSignal(),
+		}
+	}
+
+	klog.V(4).Infof("Making SPDY request to %s", u.Host)
+	err = executor.StreamWithContext(req.Context(), opts)
+
+	var exitErr exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("command terminated with exit code %d", exitErr.ExitStatus())
+	}
+	return err
+}
+
+// client-go's SPDY round tripper does its own dialing & ignores cfg.Dial, so
+// hand it an upgrade transport that dials with it instead
+func (c *cliSession) newSPDYExecutor(cfg *rest.Config, u *url.URL) (remotecommand.Executor, error) {
+	if cfg.Dial == nil || !c.customDial() {
+		return remotecommand.NewSPDYExecutor(cfg, http.MethodPost, u)
+	}
+
+	// the upgrade transport connects directly, it has no way to go through a proxy
+	proxyURL, err := effectiveProxy(cfg)(&http.Request{URL: u})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		return nil, errors.New("SPDY can't be used through a proxy with --via, --resolve, --bind-address or --connect-timeout")
+	}
+
+	tlsConfig, err := rest.TLSConfigFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	upgrader, err := spdy.NewRoundTripperWithConfig(spdy.RoundTripperConfig{
+		PingPeriod: 5 * time.Second,
+		UpgradeTransport: &http.Transport{
+			DialContext:     cfg.Dial,
+			TLSClientConfig: tlsConfig,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	rt, err := rest.HTTPWrappersForConfig(cfg, upgrader)
+	if err != nil {
+		return nil, err
+	}
+
+	return remotecommand.NewSPDYExecutorForTransports(rt, upgrader, http.MethodPost, u)
+}
+
+// terminalSizeQueue feeds terminal resizes to the SPDY executor
+type terminalSizeQueue struct {
+	state  *TerminalState
+	notify chan os.Signal
+}
+
+func (q *terminalSizeQueue) Next() *remotecommand.TerminalSize {
+	for {
+		if q.state.Initialised {
+			waitForResizeChange(q.notify)
+		}
+
+		changed, err := updateSize(q.state)
+		if err != nil {
+			klog.V(2).Infof("Failed to update terminal size: %s", err)
+			return nil
+		}
+
+		if changed || !q.state.Initialised {
+			q.state.Initialised = true
+			return &remotecommand.TerminalSize{
+				Width:  uint16(q.state.Size.Width),
+				Height: uint16(q.state.Size.Height),
+			}
+		}
+	}
+}
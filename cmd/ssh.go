@@ -0,0 +1,354 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"k8s.io/klog/v2"
+)
+
+const defaultSSHPort = "22"
+
+// sshTunnel dials TCP connections through a bastion host using direct-tcpip
+// channels. The SSH connection is made on first use and shared by all dials.
+type sshTunnel struct {
+	addr         string
+	user         string
+	identityFile string
+	knownHosts   string
+	dial         dialFunc
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func newSSHTunnel(via, identityFile, knownHosts string) (*sshTunnel, error) {
+	u, err := url.Parse(via)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bastion URL: %w", err)
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("Invalid bastion URL %s, must be ssh://[user@]host[:port]", via)
+	}
+
+	t := &sshTunnel{
+		addr:         u.Host,
+		user:         u.User.Username(),
+		identityFile: identityFile,
+		knownHosts:   knownHosts,
+	}
+	if u.Port() == "" {
+		t.addr = net.JoinHostPort(u.Hostname(), defaultSSHPort)
+	}
+	if t.user == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to determine SSH user: %w", err)
+		}
+		t.user = current.Username
+	}
+
+	return t, nil
+}
+
+func (t *sshTunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	klog.V(4).Infof("Tunnelling connection to %s via %s", addr, t.addr)
+	conn, err := client.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach %s via bastion %s: %w", addr, t.addr, err)
+	}
+	return &tunnelConn{Conn: conn, addr: tunnelAddr(addr)}, nil
+}
+
+func (t *sshTunnel) connect(ctx context.Context) (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client != nil {
+		return t.client, nil
+	}
+
+	hostKeyCallback, err := t.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	auth, closeAgent, err := t.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	// the agent is only needed while authenticating
+	defer closeAgent()
+
+	config := &ssh.ClientConfig{
+		User:              t.user,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: knownHostKeyAlgorithms(hostKeyCallback, t.addr),
+	}
+
+	dial := t.dial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	conn, err := dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to bastion %s: %w", t.addr, err)
+	}
+
+	// the handshake blocks on the connection, so a bastion that accepts and
+	// then stalls is only given until the dial context's deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, t.addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to connect to bastion %s: %w", t.addr, err)
+	}
+	// the client is shared by later dials
+	conn.SetDeadline(time.Time{})
+	klog.V(4).Infof("Connected to bastion %s as %s", t.addr, t.user)
+
+	t.client = ssh.NewClient(sshConn, chans, reqs)
+	return t.client, nil
+}
+
+func (t *sshTunnel) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client == nil {
+		return nil
+	}
+	return t.client.Close()
+}
+
+// verify the bastion against known_hosts, there is no option to skip this
+func (t *sshTunnel) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	files := []string{t.knownHosts}
+	if t.knownHosts == "" {
+		files = nil
+		for _, f := range []string{sshUserFile("known_hosts"), "/etc/ssh/ssh_known_hosts"} {
+			if _, err := os.Stat(f); err == nil {
+				files = append(files, f)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("No known_hosts file found to verify the bastion host key")
+	}
+
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load known_hosts: %w", err)
+	}
+	return callback, nil
+}
+
+// the algorithms for the key types known_hosts has for the bastion, so it
+// offers a key that can be verified rather than its preferred one. Nil when
+// the host is unknown, leaving the defaults.
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, addr string) []string {
+	// the lookup is by hostname, so any remote address will do
+	var keyErr *knownhosts.KeyError
+	if err := callback(addr, &net.TCPAddr{IP: net.IPv4zero}, probeKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var plain, certs []string
+	for _, known := range keyErr.Want {
+		algos := []string{known.Key.Type()}
+		if known.Key.Type() == ssh.KeyAlgoRSA {
+			algos = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, algo := range algos {
+			plain = append(plain, algo)
+			// @cert-authority lines are included too, so their certificate
+			// types are accepted, but after any plain key
+			if cert, ok := certAlgorithms[algo]; ok {
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if len(plain) == 0 {
+		return nil
+	}
+	return append(plain, certs...)
+}
+
+var certAlgorithms = map[string]string{
+	ssh.KeyAlgoRSASHA512:  ssh.CertAlgoRSASHA512v01,
+	ssh.KeyAlgoRSASHA256:  ssh.CertAlgoRSASHA256v01,
+	ssh.KeyAlgoRSA:        ssh.CertAlgoRSAv01,
+	ssh.KeyAlgoDSA:        ssh.CertAlgoDSAv01,
+	ssh.KeyAlgoECDSA256:   ssh.CertAlgoECDSA256v01,
+	ssh.KeyAlgoECDSA384:   ssh.CertAlgoECDSA384v01,
+	ssh.KeyAlgoECDSA521:   ssh.CertAlgoECDSA521v01,
+	ssh.KeyAlgoSKECDSA256: ssh.CertAlgoSKECDSA256v01,
+	ssh.KeyAlgoED25519:    ssh.CertAlgoED25519v01,
+	ssh.KeyAlgoSKED25519:  ssh.CertAlgoSKED25519v01,
+}
+
+// a key matching no known_hosts line, to list the keys known for a host
+type probeKey struct{}
+
+func (probeKey) Type() string                        { return "probe" }
+func (probeKey) Marshal() []byte                     { return []byte("probe") }
+func (probeKey) Verify([]byte, *ssh.Signature) error { return errors.New("Probe key") }
+
+// keys from the SSH agent, then the identity file or default keys. The
+// returned func closes the agent connection.
+func (t *sshTunnel) authMethods() ([]ssh.AuthMethod, func(), error) {
+	var methods []ssh.AuthMethod
+	closeAgent := func() {}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			klog.V(2).Infof("Unable to connect to SSH agent: %s", err)
+		} else {
+			klog.V(4).Info("Using keys from the SSH agent")
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			closeAgent = func() { conn.Close() }
+		}
+	}
+
+	files := []string{t.identityFile}
+	if t.identityFile == "" {
+		files = nil
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			files = append(files, sshUserFile(name))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, f := range files {
+		key, err := os.ReadFile(f)
+		if err != nil {
+			if t.identityFile != "" {
+				closeAgent()
+				return nil, nil, fmt.Errorf("Unable to read SSH identity: %w", err)
+			}
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		var passErr *ssh.PassphraseMissingError
+		switch {
+		case errors.As(err, &passErr):
+			klog.V(2).Infof("Skipping SSH key %s, it is passphrase protected (add it to the SSH agent instead)", f)
+			continue
+		case err != nil:
+			closeAgent()
+			return nil, nil, fmt.Errorf("Unable to parse SSH key %s: %w", f, err)
+		}
+		klog.V(4).Infof("Using SSH key %s", f)
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, errors.New("No SSH agent or keys available to authenticate to the bastion")
+	}
+	return methods, closeAgent, nil
+}
+
+// SSH channels have no deadline support & report a zero remote address, so
+// the address that was dialled is reported instead, and a deadline passing
+// closes the channel. Unlike a TCP connection it can't be used again after a
+// timeout, even if the deadline is extended.
+type tunnelConn struct {
+	net.Conn
+	addr tunnelAddr
+
+	mu         sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+	expired    atomic.Bool
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	return n, c.timeoutErr(err)
+}
+
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	return n, c.timeoutErr(err)
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readTimer = c.resetTimer(c.readTimer, t)
+	return nil
+}
+
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeTimer = c.resetTimer(c.writeTimer, t)
+	return nil
+}
+
+func (c *tunnelConn) resetTimer(timer *time.Timer, deadline time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if deadline.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(deadline), func() {
+		c.expired.Store(true)
+		c.Conn.Close()
+	})
+}
+
+// errors from closing the channel are reported as a timeout, like net.Conn
+func (c *tunnelConn) timeoutErr(err error) error {
+	if err != nil && c.expired.Load() {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tcp" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+func sshUserFile(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", name)
+}
@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestKnownHostKeyAlgorithms(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed, err := ssh.NewPublicKey(edKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := ssh.NewPublicKey(rsaKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			name: "unknown host keeps the defaults",
+			lines: []string{
+				knownhosts.Line([]string{"other.example.com"}, ed),
+			},
+		},
+		{
+			name: "single key type",
+			lines: []string{
+				knownhosts.Line([]string{"bastion.example.com"}, ed),
+				knownhosts.Line([]string{"other.example.com"}, rsaPub),
+			},
+			want: []string{ssh.KeyAlgoED25519, ssh.CertAlgoED25519v01},
+		},
+		{
+			name: "rsa keys allow the sha2 signatures",
+			lines: []string{
+				knownhosts.Line([]string{"bastion.example.com"}, rsaPub),
+			},
+			want: []string{
+				ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+				ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01,
+			},
+		},
+		{
+			name: "key for another port",
+			lines: []string{
+				knownhosts.Line([]string{"bastion.example.com:2222"}, ed),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			content := ""
+			for _, l := range tt.lines {
+				content += l + "\n"
+			}
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			tunnel := &sshTunnel{knownHosts: path}
+			callback, err := tunnel.hostKeyCallback()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := knownHostKeyAlgorithms(callback, "bastion.example.com:22")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTunnelConnectStalled(t *testing.T) {
+	// accepts connections but never sends the SSH version
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	identity := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(identity, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{l.Addr().String()}, pub)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SSH_AUTH_SOCK", "")
+	tunnel := &sshTunnel{
+		addr:         l.Addr().String(),
+		user:         "user",
+		identityFile: identity,
+		knownHosts:   knownHosts,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tunnel.DialContext(ctx, "tcp", "pod:443")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got error %v, want a deadline error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect did not time out")
+	}
+}
+
+func TestTunnelConnDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := &tunnelConn{Conn: client, addr: "pod:443"}
+
+	// a cleared deadline must not close the connection
+	conn.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	conn.SetDeadline(time.Time{})
+	time.Sleep(20 * time.Millisecond)
+	go server.Write([]byte("x"))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("read after clearing the deadline: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got error %v, want a deadline error", err)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("error %v is not a timeout", err)
+	}
+}
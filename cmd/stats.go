@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/klog/v2"
+)
+
+const (
+	statsText = "text"
+	statsJSON = "json"
+)
+
+// how often the server is pinged to measure round trip latency
+const statsPingInterval = 5 * time.Second
+
+var channelNames = [...]string{
+	streamStdIn:  "stdin",
+	streamStdOut: "stdout",
+	streamStdErr: "stderr",
+	streamErr:    "error",
+	streamResize: "resize",
+}
+
+// transferStats counts the frames & bytes on each channel of a websocket
+// session, and pings the server to measure round trip latency. nil when stats
+// are disabled.
+type transferStats struct {
+	mu       sync.Mutex
+	start    time.Time
+	end      time.Time
+	sent     [len(channelNames)]channelCount
+	received [len(channelNames)]channelCount
+	rtts     []time.Duration
+	done     chan struct{}
+}
+
+type channelCount struct {
+	bytes  int64
+	frames int64
+}
+
+// start counting & pinging once the websocket is established
+func (s *transferStats) started(ws *websocket.Conn) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.start = time.Now()
+	s.done = make(chan struct{})
+	s.mu.Unlock()
+
+	// the payload is the send time, so each pong carries its own start
+	ws.SetPongHandler(func(data string) error {
+		if len(data) != 8 {
+			return nil
+		}
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(data))))
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.rtts = append(s.rtts, time.Since(sent))
+		return nil
+	})
+
+	go s.ping(ws, s.done)
+}
+
+func (s *transferStats) ping(ws *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(statsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		if err := ws.WriteControl(websocket.PingMessage, payload, time.Now().Add(statsPingInterval)); err != nil {
+			klog.V(4).Infof("Unable to ping server: %s", err)
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *transferStats) finished() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end = time.Now()
+	close(s.done)
+}
+
+func (s *transferStats) frameSent(channel byte, n int) {
+	if s == nil || int(channel) >= len(s.sent) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent[channel].bytes += int64(n)
+	s.sent[channel].frames++
+}
+
+func (s *transferStats) frameReceived(channel byte, n int) {
+	if s == nil || int(channel) >= len(s.received) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received[channel].bytes += int64(n)
+	s.received[channel].frames++
+}
+
+type statsReport struct {
+	DurationSeconds        float64                  `json:"durationSeconds"`
+	Channels               map[string]channelReport `json:"channels"`
+	SentBytesPerSecond     float64                  `json:"sentBytesPerSecond"`
+	ReceivedBytesPerSecond float64                  `json:"receivedBytesPerSecond"`
+	Ping                   *pingReport              `json:"ping,omitempty"`
+}
+
+type channelReport struct {
+	SentBytes      int64 `json:"sentBytes"`
+	SentFrames     int64 `json:"sentFrames"`
+	ReceivedBytes  int64 `json:"receivedBytes"`
+	ReceivedFrames int64 `json:"receivedFrames"`
+}
+
+type pingReport struct {
+	Count int     `json:"count"`
+	MinMs float64 `json:"minMs"`
+	AvgMs float64 `json:"avgMs"`
+	MaxMs float64 `json:"maxMs"`
+}
+
+func (s *transferStats) report() statsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := s.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	duration := end.Sub(s.start)
+
+	r := statsReport{
+		DurationSeconds: duration.Seconds(),
+		Channels:        map[string]channelReport{},
+	}
+
+	var sent, received int64
+	for i, name := range channelNames {
+		r.Channels[name] = channelReport{
+			SentBytes:      s.sent[i].bytes,
+			SentFrames:     s.sent[i].frames,
+			ReceivedBytes:  s.received[i].bytes,
+			ReceivedFrames: s.received[i].frames,
+		}
+		sent += s.sent[i].bytes
+		received += s.received[i].bytes
+	}
+	if duration > 0 {
+		r.SentBytesPerSecond = float64(sent) / duration.Seconds()
+		r.ReceivedBytesPerSecond = float64(received) / duration.Seconds()
+	}
+
+	if len(s.rtts) > 0 {
+		min, max, total := s.rtts[0], s.rtts[0], time.Duration(0)
+		for _, rtt := range s.rtts {
+			if rtt < min {
+				min = rtt
+			}
+			if rtt > max {
+				max = rtt
+			}
+			total += rtt
+		}
+		r.Ping = &pingReport{
+			Count: len(s.rtts),
+			MinMs: durationMs(min),
+			AvgMs: durationMs(total / time.Duration(len(s.rtts))),
+			MaxMs: durationMs(max),
+		}
+	}
+
+	return r
+}
+
+func (s *transferStats) print(w io.Writer, format string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	started := !s.start.IsZero()
+	s.mu.Unlock()
+	if !started {
+		klog.V(2).Info("Transfer statistics are only collected for WebSocket sessions")
+		return
+	}
+
+	r := s.report()
+	if format == statsJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+		return
+	}
+
+	fmt.Fprintln(w, "Stats:")
+	fmt.Fprintf(w, "  %-14s %12s %8s %12s %8s\n", "channel", "sent bytes", "frames", "recv bytes", "frames")
+	for _, name := range channelNames {
+		c := r.Channels[name]
+		fmt.Fprintf(w, "  %-14s %12d %8d %12d %8d\n", name, c.SentBytes, c.SentFrames, c.ReceivedBytes, c.ReceivedFrames)
+	}
+	fmt.Fprintf(w, "  %-14s %s\n", "duration", time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Microsecond))
+	fmt.Fprintf(w, "  %-14s sent %s, received %s\n", "throughput", formatRate(r.SentBytesPerSecond), formatRate(r.ReceivedBytesPerSecond))
+	if r.Ping != nil {
+		fmt.Fprintf(w, "  %-14s min %.3fms, avg %.3fms, max %.3fms (%d pings)\n", "ping rtt", r.Ping.MinMs, r.Ping.AvgMs, r.Ping.MaxMs, r.Ping.Count)
+	} else {
+		fmt.Fprintf(w, "  %-14s n/a, no pong received\n", "ping rtt")
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func formatRate(bytesPerSec float64) string {
+	units := []string{"B/s", "KiB/s", "MiB/s", "GiB/s"}
+	i := 0
+	for bytesPerSec >= 1024 && i < len(units)-1 {
+		bytesPerSec /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", bytesPerSec, units[i])
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFormatRate(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want string
+	}{
+		{in: 0, want: "0.0 B/s"},
+		{in: 1023, want: "1023.0 B/s"},
+		{in: 1024, want: "1.0 KiB/s"},
+		{in: 1536, want: "1.5 KiB/s"},
+		{in: 5 << 20, want: "5.0 MiB/s"},
+		{in: 3 << 30, want: "3.0 GiB/s"},
+		{in: 2048 << 30, want: "2048.0 GiB/s"},
+	}
+
+	for _, tt := range tests {
+		if got := formatRate(tt.in); got != tt.want {
+			t.Errorf("formatRate(%v): got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// a finished two second session, with stdin sent & stdout received
+func testTransferStats() *transferStats {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &transferStats{
+		start: start,
+		end:   start.Add(2 * time.Second),
+		rtts:  []time.Duration{time.Millisecond, 3 * time.Millisecond, 2 * time.Millisecond},
+	}
+	s.frameSent(streamStdIn, 1024)
+	s.frameSent(streamStdIn, 1024)
+	s.frameReceived(streamStdOut, 4096)
+	s.frameReceived(streamErr, 10)
+	// unknown channels are ignored rather than counted
+	s.frameReceived(streamResize+1, 100)
+	return s
+}
+
+func TestStatsText(t *testing.T) {
+	var out bytes.Buffer
+	testTransferStats().print(&out, statsText)
+
+	want := `Stats:
+  channel          sent bytes   frames   recv bytes   frames
+  stdin                  2048        2            0        0
+  stdout                    0        0         4096        1
+  stderr                    0        0            0        0
+  error                     0        0           10        1
+  resize                    0        0            0        0
+  duration       2s
+  throughput     sent 1.0 KiB/s, received 2.0 KiB/s
+  ping rtt       min 1.000ms, avg 2.000ms, max 3.000ms (3 pings)
+`
+	if got := out.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStatsJSON(t *testing.T) {
+	var out bytes.Buffer
+	testTransferStats().print(&out, statsJSON)
+
+	var got statsReport
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out.String(), err)
+	}
+	want := statsReport{
+		DurationSeconds: 2,
+		Channels: map[string]channelReport{
+			"stdin":  {SentBytes: 2048, SentFrames: 2},
+			"stdout": {ReceivedBytes: 4096, ReceivedFrames: 1},
+			"stderr": {},
+			"error":  {ReceivedBytes: 10, ReceivedFrames: 1},
+			"resize": {},
+		},
+		SentBytesPerSecond:     1024,
+		ReceivedBytesPerSecond: 2053,
+		Ping:                   &pingReport{Count: 3, MinMs: 1, AvgMs: 2, MaxMs: 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestStatsWithoutSession(t *testing.T) {
+	var out bytes.Buffer
+
+	var disabled *transferStats
+	disabled.frameSent(streamStdIn, 1)
+	disabled.print(&out, statsText)
+
+	// enabled, but the exec didn't use a websocket
+	(&transferStats{}).print(&out, statsText)
+
+	if out.Len() != 0 {
+		t.Errorf("got output %q, want none", out.String())
+	}
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// size of stdin reads & buffered output, matching the buffer the kubelet
+// streams with
+const streamBufferSize = 32 * 1024
+
+// how long small reads & writes are held, so bursts of them are sent as a
+// single frame or write
+const coalesceDelay = 2 * time.Millisecond
+
+var streamBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, streamBufferSize)
+		return &buf
+	},
+}
+
+// read from r in chunks, calling send with frames of coalesced chunks. With a
+// zero delay only chunks that have already been read are coalesced.
+func coalesceReads(r io.Reader, delay time.Duration, send func([]byte) error) error {
+	chunks := make(chan *[]byte, 8)
+	readErr := make(chan error, 1)
+	// stops the reader once send has failed, rather than blocking forever
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(chunks)
+		for {
+			buf := streamBufferPool.Get().(*[]byte)
+			n, err := r.Read(*buf)
+			if n > 0 {
+				chunk := (*buf)[:n]
+				select {
+				case chunks <- &chunk:
+				case <-done:
+					streamBufferPool.Put(buf)
+					return
+				}
+			} else {
+				streamBufferPool.Put(buf)
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	frame := make([]byte, 0, streamBufferSize)
+	for chunk := range chunks {
+		frame = appendChunk(frame, chunk)
+
+		var timer *time.Timer
+		if delay > 0 {
+			timer = time.NewTimer(delay)
+		}
+		for len(frame) < streamBufferSize {
+			next := nextChunk(chunks, timer)
+			if next == nil {
+				break
+			}
+			frame = appendChunk(frame, next)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if err := send(frame); err != nil {
+			return err
+		}
+		frame = frame[:0]
+	}
+
+	return <-readErr
+}
+
+// the next chunk read before the timer fires, or one already read if there
+// is no timer. nil if there is none or the reader has finished.
+func nextChunk(chunks <-chan *[]byte, timer *time.Timer) *[]byte {
+	if timer == nil {
+		select {
+		case chunk := <-chunks:
+			return chunk
+		default:
+			return nil
+		}
+	}
+
+	select {
+	case chunk := <-chunks:
+		return chunk
+	case <-timer.C:
+		return nil
+	}
+}
+
+func appendChunk(frame []byte, chunk *[]byte) []byte {
+	frame = append(frame, *chunk...)
+	*chunk = (*chunk)[:cap(*chunk)]
+	streamBufferPool.Put(chunk)
+	return frame
+}
+
+// delayedFlushWriter buffers writes, flushing them once no more have arrived
+// for coalesceDelay, so a stream of small frames becomes a few large writes
+type delayedFlushWriter struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	timer *time.Timer
+	err   error
+}
+
+func newDelayedFlushWriter(w io.Writer) *delayedFlushWriter {
+	return &delayedFlushWriter{
+		w: bufio.NewWriterSize(w, streamBufferSize),
+	}
+}
+
+func (f *delayedFlushWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// report a failed background flush on the next write
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if f.timer == nil {
+		f.timer = time.AfterFunc(coalesceDelay, func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.timer = nil
+			if err := f.w.Flush(); err != nil && f.err == nil {
+				f.err = err
+			}
+		})
+	}
+	return n, nil
+}
+
+func (f *delayedFlushWriter) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	if err := f.w.Flush(); err != nil {
+		return err
+	}
+	return f.err
+}
+
+// flushBeforeWriter flushes another writer before each write, keeping the
+// order of output written to both
+type flushBeforeWriter struct {
+	w       io.Writer
+	flusher interface{ Flush() error }
+}
+
+func (f *flushBeforeWriter) Write(p []byte) (int, error) {
+	if err := f.flusher.Flush(); err != nil {
+		return 0, err
+	}
+	return f.w.Write(p)
+}
@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// returns each chunk from a separate Read, sleeping between them
+type chunkedReader struct {
+	chunks [][]byte
+	pause  time.Duration
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	if r.pause > 0 {
+		time.Sleep(r.pause)
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if len(r.chunks[0]) == 0 {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func repeatChunks(n, size int) [][]byte {
+	chunks := make([][]byte, n)
+	for i := range chunks {
+		chunks[i] = bytes.Repeat([]byte{byte('a' + i%26)}, size)
+	}
+	return chunks
+}
+
+func TestCoalesceReads(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunks    [][]byte
+		pause     time.Duration
+		delay     time.Duration
+		minFrames int
+		maxFrames int
+	}{
+		{
+			name:      "burst of small reads is one frame",
+			chunks:    repeatChunks(100, 10),
+			delay:     time.Second,
+			minFrames: 1,
+			maxFrames: 1,
+		},
+		{
+			name:      "reads further apart than the delay are separate frames",
+			chunks:    repeatChunks(5, 10),
+			pause:     20 * time.Millisecond,
+			delay:     time.Millisecond,
+			minFrames: 5,
+			maxFrames: 5,
+		},
+		{
+			name:      "frames are split at the buffer size",
+			chunks:    repeatChunks(8, streamBufferSize),
+			delay:     time.Second,
+			minFrames: 8,
+			maxFrames: 8,
+		},
+		{
+			name:      "no delay sends every read",
+			chunks:    repeatChunks(5, 10),
+			pause:     5 * time.Millisecond,
+			minFrames: 5,
+			maxFrames: 5,
+		},
+		{
+			name:      "empty input sends nothing",
+			minFrames: 0,
+			maxFrames: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := bytes.Join(tt.chunks, nil)
+
+			var got bytes.Buffer
+			frames := 0
+			err := coalesceReads(&chunkedReader{chunks: tt.chunks, pause: tt.pause}, tt.delay, func(data []byte) error {
+				frames++
+				got.Write(data)
+				return nil
+			})
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("got error %v, want EOF", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("got %d bytes, want %d", got.Len(), len(want))
+			}
+			if frames < tt.minFrames || frames > tt.maxFrames {
+				t.Errorf("got %d frames, want %d to %d", frames, tt.minFrames, tt.maxFrames)
+			}
+		})
+	}
+}
+
+// an endless reader, so only a failed send can stop coalesceReads
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestCoalesceReadsSendError(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	sendErr := errors.New("closed")
+	err := coalesceReads(zeroReader{}, 0, func([]byte) error {
+		return sendErr
+	})
+	if !errors.Is(err, sendErr) {
+		t.Fatalf("got error %v, want %v", err, sendErr)
+	}
+
+	// the reader goroutine must exit rather than block on a full channel
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("reader goroutine still running, %d goroutines, started with %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// a writer that can be read from while another goroutine writes to it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDelayedFlushWriter(t *testing.T) {
+	var out lockedBuffer
+	w := newDelayedFlushWriter(&out)
+
+	w.Write([]byte("hello "))
+	w.Write([]byte("world"))
+	if got := out.String(); got != "" {
+		t.Errorf("got %q before the flush delay, want nothing", got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for out.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := out.String(); got != "hello world" {
+		t.Errorf("got %q after the flush delay, want %q", got, "hello world")
+	}
+
+	w.Write([]byte("!"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "hello world!" {
+		t.Errorf("got %q after Flush, want %q", got, "hello world!")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestDelayedFlushWriterError(t *testing.T) {
+	w := newDelayedFlushWriter(failingWriter{})
+
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatalf("buffered write failed: %v", err)
+	}
+	time.Sleep(10 * coalesceDelay)
+
+	// the background flush failed, so the next write reports it
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Error("write after a failed flush succeeded")
+	}
+	if err := w.Flush(); err == nil {
+		t.Error("flush after a failed flush succeeded")
+	}
+}
+
+func TestFlushBeforeWriter(t *testing.T) {
+	var out bytes.Buffer
+	stdout := newDelayedFlushWriter(&out)
+	stderr := &flushBeforeWriter{w: &out, flusher: stdout}
+
+	stdout.Write([]byte("1"))
+	stderr.Write([]byte("2"))
+	stdout.Write([]byte("3"))
+	stdout.Flush()
+
+	if got := out.String(); got != "123" {
+		t.Errorf("got %q, want %q", got, "123")
+	}
+}
+
+// a reader returning at most size bytes per Read, like a pipe written to in
+// small pieces
+type smallReads struct {
+	r    io.Reader
+	size int
+}
+
+func (s *smallReads) Read(p []byte) (int, error) {
+	if len(p) > s.size {
+		p = p[:s.size]
+	}
+	return s.r.Read(p)
+}
+
+func BenchmarkCoalesceReads(b *testing.B) {
+	data := make([]byte, 16<<20)
+
+	for _, size := range []int{1 << 10, streamBufferSize} {
+		b.Run(byteSize(size), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				r := &smallReads{r: bytes.NewReader(data), size: size}
+				coalesceReads(r, coalesceDelay, func([]byte) error {
+					return nil
+				})
+			}
+		})
+	}
+}
+
+func BenchmarkDelayedFlushWriter(b *testing.B) {
+	data := make([]byte, 1<<10)
+	w := newDelayedFlushWriter(io.Discard)
+
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		w.Write(data)
+	}
+	w.Flush()
+}
+
+func byteSize(n int) string {
+	if n >= 1<<10 {
+		return fmt.Sprintf("%dKiB", n>>10)
+	}
+	return fmt.Sprintf("%dB", n)
+}
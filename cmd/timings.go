@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// sessionTimings records how long each phase of a session takes. All methods
+// are safe to call on a nil receiver, which is used when timings are disabled.
+type sessionTimings struct {
+	mu           sync.Mutex
+	start        time.Time
+	phases       []phaseTiming
+	requestStart time.Time
+	execStart    time.Time
+	credsOnce    sync.Once
+	outputOnce   sync.Once
+}
+
+type phaseTiming struct {
+	Name     string
+	Duration time.Duration
+}
+
+func newSessionTimings() *sessionTimings {
+	return &sessionTimings{
+		start: time.Now(),
+	}
+}
+
+func (t *sessionTimings) record(name string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phases = append(t.phases, phaseTiming{Name: name, Duration: d})
+}
+
+// start timing a phase, call the returned func once it is complete
+func (t *sessionTimings) track(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.record(name, time.Since(start))
+	}
+}
+
+// mark the start of a request to the API server or kubelet, so credential
+// acquisition by the auth round trippers can be measured
+func (t *sessionTimings) requestStarted() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requestStart = time.Now()
+}
+
+func (t *sessionTimings) credentialsAcquired() {
+	if t == nil {
+		return
+	}
+	t.credsOnce.Do(func() {
+		t.mu.Lock()
+		start := t.requestStart
+		t.mu.Unlock()
+		if !start.IsZero() {
+			t.record("credentials", time.Since(start))
+		}
+	})
+}
+
+func (t *sessionTimings) execStarted() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.execStart = time.Now()
+}
+
+func (t *sessionTimings) outputReceived() {
+	if t == nil {
+		return
+	}
+	t.outputOnce.Do(func() {
+		t.mu.Lock()
+		start := t.execStart
+		t.mu.Unlock()
+		if !start.IsZero() {
+			t.record("first byte", time.Since(start))
+		}
+	})
+}
+
+// trace hooks for the websocket dial, covering DNS, TCP, TLS & the upgrade.
+// Happy Eyeballs connects to several addresses in parallel, so connects are
+// timed per address and only the successful ones recorded.
+func (t *sessionTimings) clientTrace() *httptrace.ClientTrace {
+	if t == nil {
+		return nil
+	}
+
+	var dnsStart, tlsStart, connDone time.Time
+	connectStart := map[string]time.Time{}
+	// the start time set by a hook, read under the lock
+	since := func(start *time.Time) time.Duration {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return time.Since(*start)
+	}
+	mark := func(start *time.Time) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		*start = time.Now()
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mark(&dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.record("dns", since(&dnsStart))
+		},
+		ConnectStart: func(_, addr string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			connectStart[addr] = time.Now()
+		},
+		ConnectDone: func(_, addr string, err error) {
+			t.mu.Lock()
+			start, ok := connectStart[addr]
+			delete(connectStart, addr)
+			t.mu.Unlock()
+			if ok && err == nil {
+				t.record("tcp connect", time.Since(start))
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			mark(&connDone)
+		},
+		TLSHandshakeStart: func() {
+			mark(&tlsStart)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			mark(&connDone)
+			t.record("tls handshake", since(&tlsStart))
+		},
+		GotFirstResponseByte: func() {
+			t.record("upgrade", since(&connDone))
+		},
+	}
+}
+
+func (t *sessionTimings) print(w io.Writer) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintln(w, "Timings:")
+	for _, p := range t.phases {
+		fmt.Fprintf(w, "  %-14s %s\n", p.Name, p.Duration.Round(time.Microsecond))
+	}
+	fmt.Fprintf(w, "  %-14s %s\n", "total", time.Since(t.start).Round(time.Microsecond))
+}
+
+// credentialTimer sits inside the auth round trippers, so is reached once
+// any token or credential plugin has been resolved
+type credentialTimer struct {
+	timings *sessionTimings
+	rt      http.RoundTripper
+}
+
+func (c *credentialTimer) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.timings.credentialsAcquired()
+	return c.rt.RoundTrip(r)
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestClientTraceConnect(t *testing.T) {
+	timings := newSessionTimings()
+	trace := timings.clientTrace()
+
+	// parallel attempts, as made by Happy Eyeballs, one of which fails
+	var wg sync.WaitGroup
+	for _, addr := range []string{"[2001:db8::1]:443", "192.0.2.1:443"} {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			trace.ConnectStart("tcp", addr)
+			var err error
+			if addr == "[2001:db8::1]:443" {
+				err = errors.New("connection refused")
+			}
+			trace.ConnectDone("tcp", addr, err)
+		}(addr)
+	}
+	wg.Wait()
+
+	if len(timings.phases) != 1 {
+		t.Fatalf("got %d phases %v, want a single tcp connect", len(timings.phases), timings.phases)
+	}
+	if timings.phases[0].Name != "tcp connect" {
+		t.Errorf("got phase %q, want tcp connect", timings.phases[0].Name)
+	}
+}
+
+func TestNilSessionTimings(t *testing.T) {
+	var timings *sessionTimings
+	if timings.clientTrace() != nil {
+		t.Error("nil timings returned a trace")
+	}
+	timings.track("kubeconfig")()
+	timings.outputReceived()
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,7 +22,19 @@ type WebsocketRoundTripper struct {
 	Dialer     *websocket.Dialer
 	TermState  *TerminalState
 	SendBuffer bytes.Buffer
+	Stdin      bool
 	OneShot    bool
+	Timings    *sessionTimings
+	Protocol   string
+	Compress   *compressionStats
+	Stats      *transferStats
+	Dump       *frameDumper
+	LogPayload bool
+	features   protocolFeatures
+	writeLock  sync.Mutex
+	output     *delayedFlushWriter
+	recvBuf    bytes.Buffer
+	decodeBuf  []byte
 }
 
 type ApiServerError struct {
@@ -29,37 +42,138 @@ type ApiServerError struct {
 	Message string `json:"message"`
 }
 
+// UpgradeError is returned when the server refuses the websocket upgrade
+type UpgradeError struct {
+	StatusCode int
+	Reason     string
+	Err        error
+}
+
+func (e *UpgradeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UpgradeError) Unwrap() error {
+	return e.Err
+}
+
+// whether the server, or something in front of it, doesn't do websockets,
+// rather than refusing the request itself, eg. with a 403
+func (e *UpgradeError) refused() bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusUpgradeRequired, http.StatusNotImplemented:
+		return true
+	}
+	// answered without upgrading, or upgraded without the websocket headers
+	// or a subprotocol we understand
+	return e.StatusCode < http.StatusBadRequest
+}
+
 func (d *WebsocketRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
-	conn, resp, err := d.Dialer.Dial(r.URL.String(), r.Header)
+	conn, resp, err := dialWebsocket(d.Dialer, r)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	d.Compress.upgraded(resp)
+	defer d.Compress.log()
+
+	// servers that don't echo a subprotocol are speaking the original version
+	d.Protocol = conn.Subprotocol()
+	if d.Protocol == "" {
+		d.Protocol = "channel.k8s.io"
+	}
+	features, ok := channelProtocols[d.Protocol]
+	if !ok {
+		return nil, &UpgradeError{
+			StatusCode: resp.StatusCode,
+			Err:        fmt.Errorf("Server negotiated unsupported subprotocol: %s", d.Protocol),
+		}
+	}
+	d.features = features
+	klog.V(4).Infof("Negotiated subprotocol %s", d.Protocol)
+	d.Dump.negotiated(d.Protocol)
+
+	d.Stats.started(conn)
+	defer d.Stats.finished()
+
+	return resp, d.WsCallback(conn)
+}
+
+// dial and decode any upgrade failure into a readable error
+func dialWebsocket(dialer *websocket.Dialer, r *http.Request) (*websocket.Conn, *http.Response, error) {
+	conn, resp, err := dialer.DialContext(r.Context(), r.URL.String(), r.Header)
 	if e, ok := err.(*net.OpError); ok {
-		return nil, fmt.Errorf("Error connecting to %s, %s", e.Addr, e.Err)
+		return nil, nil, fmt.Errorf("Error connecting to %s, %s", e.Addr, e.Err)
 	} else if err != nil && err.Error() != "websocket: bad handshake" {
-		return nil, fmt.Errorf("Error connecting: %w", err)
-	} else if resp.StatusCode != 101 {
-		if resp.Header.Get("Content-Type") == "application/json" {
-			var msg ApiServerError
-			jerr := json.NewDecoder(resp.Body).Decode(&msg)
-			if jerr != nil {
-				return nil, fmt.Errorf("Error from server, unable to decode response: %w", err)
-			}
-			return nil, fmt.Errorf("Error from server (%s): %s", msg.Reason, msg.Message)
-		} else {
-			body, ioerr := io.ReadAll(resp.Body)
-			if ioerr != nil {
-				return nil, fmt.Errorf("Server Error, unable to read body: %w", err)
-			}
-			resp.Body.Close()
+		return nil, nil, fmt.Errorf("Error connecting: %w", err)
+	} else if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, nil, decodeUpgradeError(resp, err)
+	}
+	return conn, resp, nil
+}
 
-			return nil, fmt.Errorf("Error from server: %s", body)
+func decodeUpgradeError(resp *http.Response, err error) *UpgradeError {
+	uerr := &UpgradeError{
+		StatusCode: resp.StatusCode,
+	}
+
+	if resp.StatusCode < http.StatusBadRequest {
+		uerr.Err = fmt.Errorf("Server did not upgrade to a websocket (HTTP %d)", resp.StatusCode)
+		return uerr
+	}
+
+	if resp.Header.Get("Content-Type") == "application/json" {
+		var msg ApiServerError
+		jerr := json.NewDecoder(resp.Body).Decode(&msg)
+		if jerr != nil {
+			uerr.Err = fmt.Errorf("Error from server, unable to decode response: %w", err)
+			return uerr
 		}
+		uerr.Reason = msg.Reason
+		uerr.Err = fmt.Errorf("Error from server (%s): %s", msg.Reason, msg.Message)
+		return uerr
 	}
-	defer conn.Close()
-	return resp, d.WsCallback(conn)
+
+	body, ioerr := io.ReadAll(resp.Body)
+	if ioerr != nil {
+		uerr.Err = fmt.Errorf("Server Error, unable to read body: %w", err)
+		return uerr
+	}
+	resp.Body.Close()
+
+	uerr.Err = fmt.Errorf("Error from server: %s", body)
+	return uerr
 }
 
 func (d *WebsocketRoundTripper) WsCallback(ws *websocket.Conn) error {
 	errChan := make(chan error, 4)
 
+	// piped stdin is sent until EOF, decided before the goroutines start as
+	// both the send & receive sides depend on it
+	stdIn, _, _ := term.StdStreams()
+	if stdInFile, ok := stdIn.(*os.File); ok {
+		if stat, err := stdInFile.Stat(); err == nil && (stat.Mode()&os.ModeCharDevice) == 0 {
+			d.OneShot = true
+		}
+	}
+	if d.OneShot && d.Stdin && !d.features.closeStdin {
+		klog.V(2).Infof("%s has no way to close stdin, commands reading it until EOF won't exit (v5.channel.k8s.io needs Kubernetes 1.30+)", d.Protocol)
+	}
+
+	// a raw terminal is written to directly for responsiveness, otherwise
+	// bursts of output are buffered into larger writes
+	if !d.TermState.IsRaw {
+		_, stdOut, _ := term.StdStreams()
+		d.output = newDelayedFlushWriter(stdOut)
+		defer func() {
+			if err := d.output.Flush(); err != nil {
+				klog.V(2).Infof("Unable to write output: %s", err)
+			}
+		}()
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(3)
 
@@ -90,77 +204,74 @@ func (d *WebsocketRoundTripper) WsCallback(ws *websocket.Conn) error {
 func (d *WebsocketRoundTripper) concurrentSend(wg *sync.WaitGroup, ws *websocket.Conn, errChan chan error) {
 	defer wg.Done()
 
-	buf := make([]byte, 1025)
 	stdIn, _, _ := term.StdStreams()
 
-	stdInFile, ok := stdIn.(*os.File)
-	if !ok {
+	if _, ok := stdIn.(*os.File); !ok {
 		errChan <- errors.New("Error determining input type")
 		return
 	}
 
-	stat, _ := stdInFile.Stat()
-	if (stat.Mode() & os.ModeCharDevice) == 0 {
-		d.OneShot = true
-
-		bytes, err := io.ReadAll(stdIn)
-		if err != nil {
+	if d.OneShot {
+		// streamed rather than read into memory, with small writes to the
+		// pipe coalesced into larger frames
+		err := coalesceReads(stdIn, coalesceDelay, func(data []byte) error {
+			d.logPayload("Sending", streamStdIn, data)
+			return d.writeFrame(ws, streamStdIn, data)
+		})
+		if err != nil && !errors.Is(err, io.EOF) {
 			errChan <- err
 			return
 		}
 
-		stdin := append([]byte{streamStdIn}, bytes...)
-		klog.V(4).Infof("got stdin %s", string(stdin))
-
-		err = ws.WriteMessage(websocket.BinaryMessage, stdin)
-		if err != nil {
-			errChan <- err
-			return
+		// without a way to signal EOF, commands reading stdin until it is
+		// closed run until they are interrupted
+		if d.features.closeStdin {
+			if err := d.writeFrame(ws, streamClose, []byte{streamStdIn}); err != nil {
+				errChan <- err
+			}
 		}
 		return
 	}
 
-	for {
-		n, err := stdIn.Read(buf[1:])
-		if err != nil {
-			errChan <- err
-			return
-		}
-
-		d.SendBuffer.Write(buf[1:n])
+	// keystrokes are sent as soon as they are read, without waiting
+	errChan <- coalesceReads(stdIn, 0, func(data []byte) error {
+		d.SendBuffer.Write(data)
 		d.SendBuffer.Write([]byte{13, 10})
-		err = ws.WriteMessage(websocket.BinaryMessage, buf[:n+1])
-		if err != nil {
-			errChan <- err
-			return
-		}
-	}
+		d.logPayload("Sending", streamStdIn, data)
+		return d.writeFrame(ws, streamStdIn, data)
+	})
 }
 
 func (d *WebsocketRoundTripper) concurrentRecv(wg *sync.WaitGroup, ws *websocket.Conn, errChan chan error) {
 	defer wg.Done()
 
 	_, stdOut, stdErr := term.StdStreams()
+	if d.output != nil {
+		stdOut = d.output
+		stdErr = &flushBeforeWriter{w: stdErr, flusher: d.output}
+	}
 
 	for {
-		msgType, buf, err := ws.ReadMessage()
+		buf, err := d.readFrame(ws)
 		if err != nil {
+			d.Dump.closed(err)
 			errChan <- err
 			return
 		}
-		if msgType != websocket.BinaryMessage {
-			errChan <- errors.New("Received unexpected websocket message")
-			return
+		if len(buf) > 0 {
+			d.Stats.frameReceived(buf[0], len(buf)-1)
 		}
 		if len(buf) > 1 {
 			var w io.Writer
 			switch buf[0] {
 			case streamStdOut:
 				w = stdOut
+				d.Timings.outputReceived()
 			case streamStdErr:
 				w = stdErr
+				d.Timings.outputReceived()
 			case streamErr:
-				if err := parseStreamErr(buf[1:]); err != nil {
+				if err := d.parseStreamErr(buf[1:]); err != nil {
 					errChan <- err
 					return
 				}
@@ -174,15 +285,12 @@ func (d *WebsocketRoundTripper) concurrentRecv(wg *sync.WaitGroup, ws *websocket
 			}
 
 			out := buf[1:]
+			d.logPayload("Received", buf[0], out)
 			_, err = w.Write(out)
 			if err != nil {
 				errChan <- err
 				return
 			}
-
-			if d.OneShot {
-				break
-			}
 		}
 		d.SendBuffer.Reset()
 	}
@@ -190,6 +298,10 @@ func (d *WebsocketRoundTripper) concurrentRecv(wg *sync.WaitGroup, ws *websocket
 
 func (d *WebsocketRoundTripper) concurrentResize(wg *sync.WaitGroup, ws *websocket.Conn, errChan chan error) {
 	defer wg.Done()
+	if d.TermState.IsRaw && !d.features.resize {
+		klog.V(4).Infof("Terminal resizing is not supported by %s", d.Protocol)
+		return
+	}
 	if d.TermState.IsRaw {
 		resizeNotify := registerResizeSignal()
 
@@ -207,9 +319,7 @@ func (d *WebsocketRoundTripper) concurrentResize(wg *sync.WaitGroup, ws *websock
 					errChan <- fmt.Errorf("Failed to marshal JSON: %w", err)
 					return
 				}
-				msg := []byte(fmt.Sprintf("%s%s", "\x04", res))
-
-				err = ws.WriteMessage(websocket.BinaryMessage, msg)
+				err = d.writeFrame(ws, streamResize, res)
 				if err != nil {
 					errChan <- fmt.Errorf("Failed to write msg to channel: %w", err)
 					return
@@ -222,6 +332,90 @@ func (d *WebsocketRoundTripper) concurrentResize(wg *sync.WaitGroup, ws *websock
 	}
 }
 
+// stdin & output can hold secrets, so are only logged when asked for
+func (d *WebsocketRoundTripper) logPayload(action string, channel byte, data []byte) {
+	if !d.LogPayload || !klog.V(4).Enabled() {
+		return
+	}
+	klog.V(4).Infof("%s %d bytes on %s: %q", action, len(data), channelNames[channel], data)
+}
+
+// send data on a channel, encoding it for the text based protocols
+func (d *WebsocketRoundTripper) writeFrame(ws *websocket.Conn, channel byte, data []byte) error {
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	if d.features.base64 {
+		msg := make([]byte, 1+base64.StdEncoding.EncodedLen(len(data)))
+		msg[0] = '0' + channel
+		base64.StdEncoding.Encode(msg[1:], data)
+		d.Compress.messageWritten(len(msg))
+		if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+			return err
+		}
+		d.Dump.frame("send", websocket.TextMessage, msg[0], msg[1:])
+		d.Stats.frameSent(channel, len(data))
+		return nil
+	}
+
+	w, err := ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{channel}); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	d.Compress.messageWritten(1 + len(data))
+	if err := w.Close(); err != nil {
+		return err
+	}
+	d.Dump.frame("send", websocket.BinaryMessage, channel, data)
+	d.Stats.frameSent(channel, len(data))
+	return nil
+}
+
+// read the next message, returned as a channel byte followed by the data. The
+// buffer is reused, so is only valid until the next call.
+func (d *WebsocketRoundTripper) readFrame(ws *websocket.Conn) ([]byte, error) {
+	msgType, r, err := ws.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	d.recvBuf.Reset()
+	if _, err := d.recvBuf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	buf := d.recvBuf.Bytes()
+	d.Compress.messageRead(len(buf))
+	if len(buf) > 0 {
+		d.Dump.frame("recv", msgType, buf[0], buf[1:])
+	}
+
+	switch {
+	case msgType == websocket.BinaryMessage && !d.features.base64:
+		return buf, nil
+	case msgType == websocket.TextMessage && d.features.base64:
+		if len(buf) == 0 {
+			return buf, nil
+		}
+		size := 1 + base64.StdEncoding.DecodedLen(len(buf)-1)
+		if cap(d.decodeBuf) < size {
+			d.decodeBuf = make([]byte, size)
+		}
+		data := d.decodeBuf[:size]
+		n, err := base64.StdEncoding.Decode(data[1:], buf[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode base64 message: %w", err)
+		}
+		data[0] = buf[0] - '0'
+		return data[:n+1], nil
+	}
+	return nil, errors.New("Received unexpected websocket message")
+}
+
 type streamError struct {
 	Status  string             `json:"status"`
 	Message string             `json:"message"`
@@ -238,7 +432,12 @@ type streamErrorReason struct {
 	Message string `json:"message"`
 }
 
-func parseStreamErr(buf []byte) error {
+func (d *WebsocketRoundTripper) parseStreamErr(buf []byte) error {
+	// before v4 the error channel carries a plain text message
+	if !d.features.statusError {
+		return errors.New(string(buf))
+	}
+
 	var msg streamError
 	jerr := json.Unmarshal(buf, &msg)
 	if jerr != nil {
@@ -0,0 +1,339 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// a websocket connected to a local server, which runs handle on its end
+func newTestWebsocket(tb testing.TB, handle func(*websocket.Conn)) *websocket.Conn {
+	tb.Helper()
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(conn)
+	}))
+	tb.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// read & discard messages until the connection is closed
+func discardMessages(conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+// echo every message back with the same type
+func echoMessages(conn *websocket.Conn) {
+	for {
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(msgType, msg); err != nil {
+			return
+		}
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		channel  byte
+		data     string
+		wantType int
+		wantMsg  string
+	}{
+		{
+			name:     "binary",
+			protocol: "v4.channel.k8s.io",
+			channel:  streamStdIn,
+			data:     "hi",
+			wantType: websocket.BinaryMessage,
+			wantMsg:  "\x00hi",
+		},
+		{
+			name:     "base64 stdin",
+			protocol: "v4.base64.channel.k8s.io",
+			channel:  streamStdIn,
+			data:     "hi",
+			wantType: websocket.TextMessage,
+			wantMsg:  "0aGk=",
+		},
+		{
+			name:     "base64 resize channel",
+			protocol: "v4.base64.channel.k8s.io",
+			channel:  streamResize,
+			data:     `{"Width":80,"Height":24}`,
+			wantType: websocket.TextMessage,
+			wantMsg:  "4eyJXaWR0aCI6ODAsIkhlaWdodCI6MjR9",
+		},
+		{
+			name:     "base64 empty",
+			protocol: "base64.channel.k8s.io",
+			channel:  streamStdIn,
+			wantType: websocket.TextMessage,
+			wantMsg:  "0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type message struct {
+				msgType int
+				data    []byte
+			}
+			received := make(chan message, 1)
+			ws := newTestWebsocket(t, func(conn *websocket.Conn) {
+				msgType, data, err := conn.ReadMessage()
+				if err == nil {
+					received <- message{msgType, data}
+				}
+			})
+
+			d := &WebsocketRoundTripper{features: channelProtocols[tt.protocol]}
+			if err := d.writeFrame(ws, tt.channel, []byte(tt.data)); err != nil {
+				t.Fatal(err)
+			}
+
+			got := <-received
+			if got.msgType != tt.wantType {
+				t.Errorf("got message type %d, want %d", got.msgType, tt.wantType)
+			}
+			if string(got.data) != tt.wantMsg {
+				t.Errorf("got message %q, want %q", got.data, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		msgType  int
+		msg      string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "binary",
+			protocol: "v4.channel.k8s.io",
+			msgType:  websocket.BinaryMessage,
+			msg:      "\x01out",
+			want:     "\x01out",
+		},
+		{
+			name:     "base64 stdout",
+			protocol: "v4.base64.channel.k8s.io",
+			msgType:  websocket.TextMessage,
+			msg:      "1b3V0",
+			want:     "\x01out",
+		},
+		{
+			name:     "base64 error channel",
+			protocol: "v4.base64.channel.k8s.io",
+			msgType:  websocket.TextMessage,
+			msg:      "3e30=",
+			want:     "\x03{}",
+		},
+		{
+			name:     "base64 channel only",
+			protocol: "base64.channel.k8s.io",
+			msgType:  websocket.TextMessage,
+			msg:      "2",
+			want:     "\x02",
+		},
+		{
+			name:     "invalid base64",
+			protocol: "v4.base64.channel.k8s.io",
+			msgType:  websocket.TextMessage,
+			msg:      "1not base64!",
+			wantErr:  true,
+		},
+		{
+			name:     "binary message on a base64 protocol",
+			protocol: "v4.base64.channel.k8s.io",
+			msgType:  websocket.BinaryMessage,
+			msg:      "\x01out",
+			wantErr:  true,
+		},
+		{
+			name:     "text message on a binary protocol",
+			protocol: "v4.channel.k8s.io",
+			msgType:  websocket.TextMessage,
+			msg:      "1b3V0",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := newTestWebsocket(t, func(conn *websocket.Conn) {
+				conn.WriteMessage(tt.msgType, []byte(tt.msg))
+				discardMessages(conn)
+			})
+
+			d := &WebsocketRoundTripper{features: channelProtocols[tt.protocol]}
+			got, err := d.readFrame(ws)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// every byte value on every channel survives the trip, whatever the encoding
+func TestFrameRoundTrip(t *testing.T) {
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	for _, proto := range []string{"v4.channel.k8s.io", "v4.base64.channel.k8s.io"} {
+		t.Run(proto, func(t *testing.T) {
+			ws := newTestWebsocket(t, echoMessages)
+			d := &WebsocketRoundTripper{features: channelProtocols[proto]}
+
+			for _, channel := range []byte{streamStdIn, streamStdOut, streamStdErr, streamErr, streamResize} {
+				if err := d.writeFrame(ws, channel, data); err != nil {
+					t.Fatal(err)
+				}
+				got, err := d.readFrame(ws)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got[0] != channel || !bytes.Equal(got[1:], data) {
+					t.Errorf("channel %d: got channel %d with %d bytes", channel, got[0], len(got)-1)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteFrame(b *testing.B) {
+	for _, proto := range []string{"v4.channel.k8s.io", "v4.base64.channel.k8s.io"} {
+		for _, size := range []int{1 << 10, streamBufferSize} {
+			b.Run(proto+"/"+byteSize(size), func(b *testing.B) {
+				ws := newTestWebsocket(b, discardMessages)
+				d := &WebsocketRoundTripper{features: channelProtocols[proto]}
+				data := make([]byte, size)
+
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := d.writeFrame(ws, streamStdIn, data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// answers the upgrade by hand, so the response can be one gorilla's upgrader
+// would refuse to send
+func rawSwitchingProtocols(w http.ResponseWriter, r *http.Request, headers string) {
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	accept := sha1.Sum([]byte(r.Header.Get("Sec-Websocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nSec-WebSocket-Accept: %s\r\n%s\r\n",
+		base64.StdEncoding.EncodeToString(accept[:]), headers)
+	buf.Flush()
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	status := func(code int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		wantRefused bool
+	}{
+		{name: "bad request", handler: status(http.StatusBadRequest), wantRefused: true},
+		{name: "upgrade required", handler: status(http.StatusUpgradeRequired), wantRefused: true},
+		{name: "not implemented", handler: status(http.StatusNotImplemented), wantRefused: true},
+		{name: "ok without upgrading", handler: status(http.StatusOK), wantRefused: true},
+		{name: "unauthorized", handler: status(http.StatusUnauthorized)},
+		{name: "forbidden", handler: status(http.StatusForbidden)},
+		{name: "not found", handler: status(http.StatusNotFound)},
+		{name: "internal error", handler: status(http.StatusInternalServerError)},
+		{
+			name: "switching protocols without an upgrade header",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				rawSwitchingProtocols(w, r, "Connection: Upgrade\r\n")
+			},
+			wantRefused: true,
+		},
+		{
+			name: "unsupported subprotocol",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				rawSwitchingProtocols(w, r, "Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Protocol: v9.channel.k8s.io\r\n")
+			},
+			wantRefused: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodGet, "ws"+strings.TrimPrefix(server.URL, "http"), http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rt := &WebsocketRoundTripper{Dialer: &websocket.Dialer{Subprotocols: protocols}}
+			_, err = rt.RoundTrip(req)
+
+			var upgradeErr *UpgradeError
+			if !errors.As(err, &upgradeErr) {
+				t.Fatalf("got error %v, want an upgrade error", err)
+			}
+			if upgradeErr.refused() != tt.wantRefused {
+				t.Errorf("got refused %t for %v, want %t", upgradeErr.refused(), err, tt.wantRefused)
+			}
+		})
+	}
+}